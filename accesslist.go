@@ -0,0 +1,283 @@
+package ratebroker
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// accessList matches keys against exact keys, prefixes and CIDR ranges.
+//
+// Entries are parsed by parseAccessEntry. A CIDR range such as "10.0.0.0/8" matches
+// the IP keys in the range, see parseKeyAddr. An entry ending in "*" such as
+// "internal-*" matches the keys with that prefix. Any other entry matches the key
+// exactly, and is stored as hashed by WithKeyHashing, see storedEntry.
+type accessList struct {
+	exact    map[string]struct{}
+	prefixes map[string]struct{}
+	ranges   map[netip.Prefix]struct{}
+}
+
+func newAccessList() *accessList {
+	return &accessList{
+		exact:    make(map[string]struct{}),
+		prefixes: make(map[string]struct{}),
+		ranges:   make(map[netip.Prefix]struct{}),
+	}
+}
+
+// accessEntry is a parsed accessList entry, only one of its fields is set.
+type accessEntry struct {
+	exact  string
+	prefix *string
+	ranged netip.Prefix
+}
+
+func parseAccessEntry(entry string) (accessEntry, error) {
+	if entry == "" {
+		return accessEntry{}, fmt.Errorf("%w: empty access list entry", ErrInvalidControl)
+	}
+
+	if ranged, err := netip.ParsePrefix(entry); err == nil {
+		return accessEntry{ranged: ranged.Masked()}, nil
+	}
+
+	if prefix, ok := strings.CutSuffix(entry, "*"); ok {
+		return accessEntry{prefix: &prefix}, nil
+	}
+
+	return accessEntry{exact: entry}, nil
+}
+
+func (l *accessList) add(entry accessEntry) {
+	switch {
+	case entry.ranged.IsValid():
+		l.ranges[entry.ranged] = struct{}{}
+	case entry.prefix != nil:
+		l.prefixes[*entry.prefix] = struct{}{}
+	default:
+		l.exact[entry.exact] = struct{}{}
+	}
+}
+
+func (l *accessList) remove(entry accessEntry) {
+	switch {
+	case entry.ranged.IsValid():
+		delete(l.ranges, entry.ranged)
+	case entry.prefix != nil:
+		delete(l.prefixes, *entry.prefix)
+	default:
+		delete(l.exact, entry.exact)
+	}
+}
+
+// entries returns the entries of the list in the format parsed by parseAccessEntry, sorted.
+func (l *accessList) entries() []string {
+	entries := make([]string, 0, len(l.exact)+len(l.prefixes)+len(l.ranges))
+	for entry := range l.exact {
+		entries = append(entries, entry)
+	}
+	for prefix := range l.prefixes {
+		entries = append(entries, prefix+"*")
+	}
+	for ranged := range l.ranges {
+		entries = append(entries, ranged.String())
+	}
+
+	sort.Strings(entries)
+	return entries
+}
+
+// match reports whether the key matches an entry. Exact entries are matched against
+// the stored key, see RateBroker.StoredKey, and prefixes and CIDR ranges against the
+// original key. Keys are matched against CIDR ranges when they hold an IP address, see
+// parseKeyAddr.
+func (l *accessList) match(key, storedKey string) bool {
+	if _, ok := l.exact[storedKey]; ok {
+		return true
+	}
+
+	for prefix := range l.prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	if len(l.ranges) == 0 {
+		return false
+	}
+
+	addr, ok := parseKeyAddr(key)
+	if !ok {
+		return false
+	}
+
+	for ranged := range l.ranges {
+		if ranged.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseKeyAddr returns the IP address of a key that is an address, with or without a
+// port, or an address namespaced by a policy such as "api:10.0.0.1", the form used by
+// ratebrokerd and ratebroker-proxy.
+func parseKeyAddr(key string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(key); err == nil {
+		return addr.Unmap(), true
+	}
+	if addrPort, err := netip.ParseAddrPort(key); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	if _, namespaced, ok := strings.Cut(key, ":"); ok {
+		if addr, err := netip.ParseAddr(namespaced); err == nil {
+			return addr.Unmap(), true
+		}
+		if addrPort, err := netip.ParseAddrPort(namespaced); err == nil {
+			return addrPort.Addr().Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// AddToAllowList exempts the keys matching entry from rate limiting on every replica.
+//
+// The entry is a CIDR range such as "10.0.0.0/8" matching IP keys, with or without a port
+// or namespaced by a policy such as "api:10.0.0.1", a prefix ending in "*" such as "internal-*", or an exact key.
+//
+// With WithKeyHashing, exact keys are hashed before they are broadcast like the keys of
+// the other events. Prefixes and CIDR ranges cannot be and are broadcast in plain text,
+// they are matched against the keys passed to TryAccept before they are hashed.
+func (rb *RateBroker) AddToAllowList(ctx context.Context, entry string) error {
+	return rb.publishControl(ctx, Message{Event: AllowListAdded, Key: rb.storedEntry(entry)})
+}
+
+// RemoveFromAllowList removes an entry added by AddToAllowList on every replica.
+func (rb *RateBroker) RemoveFromAllowList(ctx context.Context, entry string) error {
+	return rb.publishControl(ctx, Message{Event: AllowListRemoved, Key: rb.storedEntry(entry)})
+}
+
+// AddToDenyList rejects every request for the keys matching entry on every replica,
+// see AddToAllowList for the format of entries. The deny list takes precedence over
+// the allow list.
+func (rb *RateBroker) AddToDenyList(ctx context.Context, entry string) error {
+	return rb.publishControl(ctx, Message{Event: DenyListAdded, Key: rb.storedEntry(entry)})
+}
+
+// RemoveFromDenyList removes an entry added by AddToDenyList on every replica.
+func (rb *RateBroker) RemoveFromDenyList(ctx context.Context, entry string) error {
+	return rb.publishControl(ctx, Message{Event: DenyListRemoved, Key: rb.storedEntry(entry)})
+}
+
+// LoadAccessList adds the entries read from r to the allow and deny lists on every replica.
+//
+// Every line holds "allow" or "deny" followed by an entry, see AddToAllowList for the
+// format of entries. Blank lines and lines starting with "#" are ignored, e.g.:
+//
+//	# internal services
+//	allow svc-*
+//	allow 10.0.0.0/8
+//	deny 203.0.113.195
+func (rb *RateBroker) LoadAccessList(ctx context.Context, r io.Reader) error {
+	type listEntry struct{ event, entry string }
+	var entries []listEntry
+
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		list, entry, _ := strings.Cut(text, " ")
+		entry = strings.TrimSpace(entry)
+
+		var event string
+		switch list {
+		case "allow":
+			event = AllowListAdded
+		case "deny":
+			event = DenyListAdded
+		default:
+			return fmt.Errorf("line %d: expected allow or deny, got %q", line, list)
+		}
+		if _, err := parseAccessEntry(entry); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		entries = append(entries, listEntry{event, entry})
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Only apply the file once it is known to be valid
+	for _, e := range entries {
+		if err := rb.publishControl(ctx, Message{Event: e.event, Key: rb.storedEntry(e.entry)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LoadAccessListFile calls LoadAccessList with the contents of the file at path.
+func (rb *RateBroker) LoadAccessListFile(ctx context.Context, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return rb.LoadAccessList(ctx, file)
+}
+
+// storedEntry returns the entry as stored in the lists: exact keys are hashed like the
+// keys passed to TryAccept, see StoredKey, and other entries are returned as is.
+func (rb *RateBroker) storedEntry(entry string) string {
+	if parsed, err := parseAccessEntry(entry); err == nil && parsed.exact != "" {
+		return rb.StoredKey(entry)
+	}
+	return entry
+}
+
+// applyAccessList applies an allow or deny list event.
+func (rb *RateBroker) applyAccessList(msg Message) error {
+	entry, err := parseAccessEntry(msg.Key)
+	if err != nil {
+		return err
+	}
+
+	rb.controlMutex.Lock()
+	defer rb.controlMutex.Unlock()
+
+	switch msg.Event {
+	case AllowListAdded:
+		rb.allowList.add(entry)
+	case AllowListRemoved:
+		rb.allowList.remove(entry)
+	case DenyListAdded:
+		rb.denyList.add(entry)
+	case DenyListRemoved:
+		rb.denyList.remove(entry)
+	}
+	return nil
+}
+
+// checkAccessLists reports whether the key, stored as storedKey, is denied or, if not,
+// allowed without limiting.
+func (rb *RateBroker) checkAccessLists(key, storedKey string) (denied, allowed bool) {
+	rb.controlMutex.RLock()
+	defer rb.controlMutex.RUnlock()
+
+	if rb.denyList.match(key, storedKey) || (rb.config != nil && rb.config.denyList.match(key, storedKey)) {
+		return true, false
+	}
+	return false, rb.allowList.match(key, storedKey) || (rb.config != nil && rb.config.allowList.match(key, storedKey))
+}
@@ -0,0 +1,165 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+func TestRateBroker_AccessLists(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, replica1, replica2 := newControlReplicas(t, ctx, 1)
+
+	for _, entry := range []string{"svc-*", "10.0.0.0/8", "admin", "2001:db8::/32"} {
+		if err := replica1.AddToAllowList(ctx, entry); err != nil {
+			t.Fatalf("Unexpected error adding %q to the allow list: %v", entry, err)
+		}
+	}
+	for _, entry := range []string{"svc-untrusted", "10.1.0.0/16"} {
+		if err := replica1.AddToDenyList(ctx, entry); err != nil {
+			t.Fatalf("Unexpected error adding %q to the deny list: %v", entry, err)
+		}
+	}
+
+	testCases := []struct {
+		key     string
+		allowed bool // Whether every request is allowed, otherwise every request is rejected
+	}{
+		{"svc-billing", true},
+		{"admin", true},
+		{"10.2.3.4", true},
+		{"10.2.3.4:51234", true},
+		{"[2001:db8::1]:443", true},
+		{"svc-untrusted", false},
+		{"10.1.2.3", false},
+		{"10.1.2.3:8080", false},
+		{"api:10.1.2.3", false},
+		{"login:2001:db8::1", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.key, func(t *testing.T) {
+			for _, replica := range []*ratebroker.RateBroker{replica1, replica2} {
+				for i := 0; i < 3; i++ {
+					if allowed, _ := replica.TryAccept(ctx, tc.key); allowed != tc.allowed {
+						t.Fatalf("Request %d: expected allowed %v, got %v", i, tc.allowed, allowed)
+					}
+				}
+			}
+		})
+	}
+
+	if allowed, _ := replica2.TryAccept(ctx, "user1"); !allowed {
+		t.Error("Keys on neither list should be limited as usual")
+	}
+	if allowed, _ := replica2.TryAccept(ctx, "user1"); allowed {
+		t.Error("Keys on neither list should be limited as usual")
+	}
+
+	if err := replica2.RemoveFromDenyList(ctx, "10.1.0.0/16"); err != nil {
+		t.Fatalf("Unexpected error removing from the deny list: %v", err)
+	}
+	if err := replica2.RemoveFromAllowList(ctx, "svc-*"); err != nil {
+		t.Fatalf("Unexpected error removing from the allow list: %v", err)
+	}
+
+	for _, replica := range []*ratebroker.RateBroker{replica1, replica2} {
+		if allowed, _ := replica.TryAccept(ctx, "10.1.2.3"); !allowed {
+			t.Error("Key removed from the deny list should fall back to the allow list")
+		}
+	}
+	replica1.TryAccept(ctx, "svc-billing")
+	if allowed, _ := replica1.TryAccept(ctx, "svc-billing"); allowed {
+		t.Error("Key removed from the allow list should be limited")
+	}
+}
+
+func TestRateBroker_AccessListsKeyHashing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithKeyHashing([]byte("secret")),
+	)
+	rb.Start(ctx)
+	waitForConsumers(t, broker, 1)
+
+	if err := rb.AddToDenyList(ctx, "user1@example.com"); err != nil {
+		t.Fatalf("Unexpected error adding to the deny list: %v", err)
+	}
+	if err := rb.AddToAllowList(ctx, "10.0.0.0/8"); err != nil {
+		t.Fatalf("Unexpected error adding to the allow list: %v", err)
+	}
+
+	// Exact keys are broadcast hashed, CIDR ranges cannot be
+	published := broker.published()
+	if len(published) != 2 || published[0].Key != rb.StoredKey("user1@example.com") || published[1].Key != "10.0.0.0/8" {
+		t.Fatalf("Expected the exact key to be published hashed, got %+v", published)
+	}
+
+	if allowed, _ := rb.TryAccept(ctx, "user1@example.com"); allowed {
+		t.Error("Expected the hashed deny list entry to match the key")
+	}
+	for i := 0; i < 3; i++ {
+		if allowed, _ := rb.TryAccept(ctx, "10.1.2.3"); !allowed {
+			t.Fatalf("Expected request %d in the allowed range to be allowed", i)
+		}
+	}
+
+	if err := rb.RemoveFromDenyList(ctx, "user1@example.com"); err != nil {
+		t.Fatalf("Unexpected error removing from the deny list: %v", err)
+	}
+	if allowed, _ := rb.TryAccept(ctx, "user1@example.com"); !allowed {
+		t.Error("Expected the key to be limited as usual once removed from the deny list")
+	}
+}
+
+func TestRateBroker_LoadAccessList(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, replica1, replica2 := newControlReplicas(t, ctx, 1)
+
+	file := `
+# internal services
+allow svc-*
+allow 192.168.0.0/16
+
+deny 203.0.113.195
+`
+	if err := replica1.LoadAccessList(ctx, strings.NewReader(file)); err != nil {
+		t.Fatalf("Unexpected error loading the access list: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := replica2.TryAccept(ctx, "192.168.1.1"); !allowed {
+			t.Error("Allowed range should be propagated")
+		}
+		if allowed, _ := replica2.TryAccept(ctx, "203.0.113.195"); allowed {
+			t.Error("Denied key should be propagated")
+		}
+	}
+
+	for _, invalid := range []string{"block user1", "allow", "deny "} {
+		if err := replica1.LoadAccessList(ctx, strings.NewReader("allow user2\n"+invalid)); err == nil {
+			t.Errorf("Expected an error loading %q", invalid)
+		}
+	}
+
+	replica1.TryAccept(ctx, "user2")
+	if allowed, _ := replica1.TryAccept(ctx, "user2"); allowed {
+		t.Error("Invalid files should not be applied")
+	}
+}
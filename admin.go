@@ -0,0 +1,270 @@
+package ratebroker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/parkerroan/ratebroker/limiter"
+)
+
+// KeyUsage describes the state of a key on a replica, see Usage.
+type KeyUsage struct {
+	Key         string    `json:"key"` // The key as stored, see StoredKey
+	MaxRequests int       `json:"max_requests"`
+	Window      Duration  `json:"window"`
+	Used        int       `json:"used"`         // Requests counted in the current window
+	Remaining   int       `json:"remaining"`    // Requests left in the current window
+	Reset       time.Time `json:"reset"`        // When the oldest request counted leaves the window
+	BannedUntil time.Time `json:"banned_until"` // Set while the key is banned
+	Denied      bool      `json:"denied"`       // Whether the key matches the deny list
+	AllowListed bool      `json:"allow_listed"` // Whether the key matches the allow list
+	Tracked     bool      `json:"tracked"`      // Whether the RateBroker has a limiter for the key
+}
+
+// Keys returns the keys the RateBroker currently tracks a limiter for, sorted, as stored.
+func (rb *RateBroker) Keys() []string {
+	return rb.keysWithPrefix("")
+}
+
+// keysWithPrefix returns the tracked keys starting with prefix, sorted. Only the
+// matching keys are copied under the lock, they are sorted after it is released.
+func (rb *RateBroker) keysWithPrefix(prefix string) []string {
+	rb.keysMutex.Lock()
+	capacity := 0
+	if prefix == "" {
+		capacity = len(rb.keys)
+	}
+	keys := make([]string, 0, capacity)
+	for key := range rb.keys {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	rb.keysMutex.Unlock()
+
+	sort.Strings(keys)
+	return keys
+}
+
+// Usage reports the limit of the key and the requests counted against it on this replica,
+// without counting a request. Used, Remaining and Reset are only reported when the
+// limiter implements limiter.UsageReporter, as the built-in limiters do. The limiter of
+// a tracked key is switched to the key's current policy or default limit first.
+func (rb *RateBroker) Usage(key string) KeyUsage {
+	now := rb.Now()
+	storedKey := rb.StoredKey(key)
+	denied, allowed := rb.checkAccessLists(key, storedKey)
+	key = storedKey
+
+	policy := rb.policyFor(key)
+	usage := KeyUsage{
+		Key:         key,
+		MaxRequests: policy.MaxRequests,
+		Window:      Duration(policy.Window),
+		Remaining:   policy.MaxRequests,
+		Denied:      denied,
+		AllowListed: allowed,
+	}
+	if until, banned := rb.bannedUntil(key, now); banned {
+		usage.BannedUntil = until
+	}
+
+	if rb.trackedEntry(key) != nil {
+		usage.Tracked = true
+
+		// Limiters switch to a new policy or default limit on the next request for their
+		// key, switch now so that the usage of idle keys is reported against it
+		entry := rb.getOrCreateEntry(key)
+
+		if reporter, ok := entry.limiter.(limiter.UsageReporter); ok {
+			usage.Used, usage.Reset = reporter.Usage(now)
+			usage.Remaining = max(usage.MaxRequests-usage.Used, 0)
+		}
+	}
+
+	if denied || !usage.BannedUntil.IsZero() {
+		usage.Remaining = 0
+	}
+	return usage
+}
+
+// adminConfig is the configuration reported by the AdminHandler.
+type adminConfig struct {
+	ID          string                  `json:"id"`
+	MaxRequests int                     `json:"max_requests"`
+	Window      Duration                `json:"window"`
+	Limiter     string                  `json:"limiter,omitempty"`
+	ShadowMode  bool                    `json:"shadow_mode"`
+	PenaltyBox  *adminPenaltyBox        `json:"penalty_box,omitempty"`
+	Policies    map[string]PolicyConfig `json:"policies"` // Set by UpdatePolicy, by stored key
+	Bans        map[string]time.Time    `json:"bans"`     // Set by BanKey and the penalty box, by stored key
+	Allow       []string                `json:"allow"`    // Added by AddToAllowList
+	Deny        []string                `json:"deny"`     // Added by AddToDenyList
+	File        *Config                 `json:"file"`     // Applied by ApplyConfig
+}
+
+type adminPenaltyBox struct {
+	Threshold      int      `json:"threshold"`
+	Period         Duration `json:"period"`
+	BanDuration    Duration `json:"ban_duration"`
+	MaxBanDuration Duration `json:"max_ban_duration"`
+}
+
+func (rb *RateBroker) adminConfig() adminConfig {
+	limiterType, _ := rb.limiterFor()
+	file := rb.Config()
+
+	rb.controlMutex.RLock()
+	defer rb.controlMutex.RUnlock()
+
+	config := adminConfig{
+		ID:          rb.id,
+		MaxRequests: rb.maxRequests,
+		Window:      Duration(rb.window),
+		Limiter:     limiterType,
+		ShadowMode:  rb.shadowMode,
+		Policies:    make(map[string]PolicyConfig, len(rb.policies)),
+		Bans:        make(map[string]time.Time, len(rb.bans)),
+		Allow:       rb.allowList.entries(),
+		Deny:        rb.denyList.entries(),
+		File:        file,
+	}
+	if box := rb.penaltyBox; box != nil {
+		config.PenaltyBox = &adminPenaltyBox{
+			Threshold:      box.Threshold,
+			Period:         Duration(box.Period),
+			BanDuration:    Duration(box.BanDuration),
+			MaxBanDuration: Duration(box.MaxBanDuration),
+		}
+	}
+	for key, policy := range rb.policies {
+		config.Policies[key] = PolicyConfig{Key: key, MaxRequests: policy.MaxRequests, Window: Duration(policy.Window)}
+	}
+	for key, until := range rb.bans {
+		config.Bans[key] = until
+	}
+	return config
+}
+
+// defaultAdminKeysLimit is the number of keys listed by the admin /keys endpoint without a limit.
+const defaultAdminKeysLimit = 1000
+
+// AdminHandler returns an http.Handler to inspect and manage the RateBroker, e.g. to
+// find out why a client is rate limited. Changes are broadcast to every replica like
+// the RateBroker methods they call. Mount it with http.StripPrefix and keep it off the
+// public listener, it does not authenticate requests. It serves:
+//
+//	GET  /keys?prefix=P&limit=1000     the first tracked keys starting with P, see Keys
+//	GET  /usage?key=KEY                the usage of a key, see Usage
+//	POST /reset?key=KEY                reset a key, see ResetKey
+//	POST /ban?key=KEY&duration=10m     ban a key, see BanKey
+//	POST /unban?key=KEY                unban a key, see UnbanKey
+//	GET  /config                       the limits, policies, bans, lists and config file
+//	GET  /health                       the ConsumerHealth, see HealthHandler
+//
+// Keys are the ones passed to TryAccept, before hashing by WithKeyHashing. /keys lists
+// at most 1000 keys by default, the count in its response is the number of keys with
+// the prefix and truncated is set when there are more than listed.
+func AdminHandler(rb *RateBroker) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/keys", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		limit := defaultAdminKeysLimit
+		if value := r.URL.Query().Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+				writeAdminError(w, http.StatusBadRequest, "invalid limit: "+value)
+				return
+			}
+		}
+
+		keys := rb.keysWithPrefix(r.URL.Query().Get("prefix"))
+		count, truncated := len(keys), len(keys) > limit
+		if truncated {
+			keys = keys[:limit]
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]interface{}{"count": count, "keys": keys, "truncated": truncated})
+	}))
+
+	mux.HandleFunc("/usage", adminMethod(http.MethodGet, adminKey(func(w http.ResponseWriter, r *http.Request, key string) {
+		writeAdminJSON(w, http.StatusOK, rb.Usage(key))
+	})))
+
+	mux.HandleFunc("/reset", adminMethod(http.MethodPost, adminKey(func(w http.ResponseWriter, r *http.Request, key string) {
+		writeAdminResult(w, rb.ResetKey(r.Context(), key))
+	})))
+
+	mux.HandleFunc("/ban", adminMethod(http.MethodPost, adminKey(func(w http.ResponseWriter, r *http.Request, key string) {
+		duration, err := time.ParseDuration(r.URL.Query().Get("duration"))
+		if err != nil {
+			writeAdminError(w, http.StatusBadRequest, "invalid duration: "+err.Error())
+			return
+		}
+		writeAdminResult(w, rb.BanKey(r.Context(), key, duration))
+	})))
+
+	mux.HandleFunc("/unban", adminMethod(http.MethodPost, adminKey(func(w http.ResponseWriter, r *http.Request, key string) {
+		writeAdminResult(w, rb.UnbanKey(r.Context(), key))
+	})))
+
+	mux.HandleFunc("/config", adminMethod(http.MethodGet, func(w http.ResponseWriter, r *http.Request) {
+		writeAdminJSON(w, http.StatusOK, rb.adminConfig())
+	}))
+
+	mux.Handle("/health", HealthHandler(rb))
+
+	return mux
+}
+
+// adminMethod responds with 405 to requests with another method.
+func adminMethod(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.Header().Set("Allow", method)
+			writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// adminKey responds with 400 to requests without a key parameter.
+func adminKey(next func(w http.ResponseWriter, r *http.Request, key string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			writeAdminError(w, http.StatusBadRequest, "missing key parameter")
+			return
+		}
+		next(w, r, key)
+	}
+}
+
+// writeAdminResult responds with the error of a control event, or ok if there is none.
+func writeAdminResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeAdminJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case errors.Is(err, ErrInvalidControl):
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+	default:
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(v)
+}
@@ -0,0 +1,170 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+// adminRequest serves a request from the handler and decodes its JSON response into v.
+func adminRequest(t *testing.T, handler http.Handler, method, target string, v interface{}) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(method, target, nil))
+	if v != nil {
+		if err := json.NewDecoder(rec.Body).Decode(v); err != nil {
+			t.Fatalf("Unexpected error decoding response of %s %s: %v", method, target, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestRateBroker_Usage(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(3),
+		ratebroker.WithWindow(time.Minute),
+	)
+
+	usage := rb.Usage("user1")
+	if usage.Tracked || usage.Used != 0 || usage.Remaining != 3 {
+		t.Errorf("Expected an untracked key with every request remaining, got %+v", usage)
+	}
+
+	start := time.Now()
+	rb.TryAccept(context.Background(), "user1")
+	rb.TryAccept(context.Background(), "user1")
+
+	usage = rb.Usage("user1")
+	if !usage.Tracked || usage.Used != 2 || usage.Remaining != 1 || usage.MaxRequests != 3 {
+		t.Errorf("Expected 2 requests used and 1 remaining, got %+v", usage)
+	}
+	if usage.Reset.Before(start.Add(time.Minute)) || usage.Reset.After(time.Now().Add(time.Minute)) {
+		t.Errorf("Expected the reset a window after the first request, got %v", usage.Reset)
+	}
+
+	if keys := rb.Keys(); len(keys) != 1 || keys[0] != "user1" {
+		t.Errorf("Expected user1 to be tracked, got %v", keys)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, replica1, replica2 := newControlReplicas(t, ctx, 2)
+	handler := ratebroker.AdminHandler(replica1)
+
+	replica1.TryAccept(ctx, "user1")
+	replica1.TryAccept(ctx, "user1")
+
+	var keys struct {
+		Count int      `json:"count"`
+		Keys  []string `json:"keys"`
+	}
+	if code := adminRequest(t, handler, http.MethodGet, "/keys", &keys); code != http.StatusOK || keys.Count != 1 || keys.Keys[0] != "user1" {
+		t.Errorf("Expected user1 to be listed, got %d %+v", code, keys)
+	}
+
+	var usage ratebroker.KeyUsage
+	adminRequest(t, handler, http.MethodGet, "/usage?key=user1", &usage)
+	if usage.Used != 2 || usage.Remaining != 0 || time.Duration(usage.Window) != time.Minute {
+		t.Errorf("Expected the key to be at its limit, got %+v", usage)
+	}
+
+	if code := adminRequest(t, handler, http.MethodPost, "/reset?key=user1", nil); code != http.StatusOK {
+		t.Fatalf("Expected the key to be reset, got %d", code)
+	}
+	if allowed, _ := replica2.TryAccept(ctx, "user1"); !allowed {
+		t.Error("Reset should be broadcast to every replica")
+	}
+
+	if code := adminRequest(t, handler, http.MethodPost, "/ban?key=user2&duration=1h", nil); code != http.StatusOK {
+		t.Fatalf("Expected the key to be banned, got %d", code)
+	}
+	adminRequest(t, handler, http.MethodGet, "/usage?key=user2", &usage)
+	if usage.BannedUntil.IsZero() || usage.Remaining != 0 {
+		t.Errorf("Expected the key to be banned, got %+v", usage)
+	}
+
+	var config struct {
+		MaxRequests int                  `json:"max_requests"`
+		Bans        map[string]time.Time `json:"bans"`
+	}
+	adminRequest(t, handler, http.MethodGet, "/config", &config)
+	if config.MaxRequests != 2 || config.Bans["user2"].IsZero() {
+		t.Errorf("Expected the limits and the ban in the config, got %+v", config)
+	}
+
+	if code := adminRequest(t, handler, http.MethodPost, "/unban?key=user2", nil); code != http.StatusOK {
+		t.Fatalf("Expected the key to be unbanned, got %d", code)
+	}
+	if allowed, _ := replica2.TryAccept(ctx, "user2"); !allowed {
+		t.Error("Unban should be broadcast to every replica")
+	}
+
+	var health ratebroker.ConsumerHealth
+	if code := adminRequest(t, handler, http.MethodGet, "/health", &health); code != http.StatusOK || !health.Ready {
+		t.Errorf("Expected a healthy replica, got %d %+v", code, health)
+	}
+}
+
+func TestAdminHandler_KeysLimit(t *testing.T) {
+	rb := ratebroker.NewRateBroker()
+	handler := ratebroker.AdminHandler(rb)
+
+	for _, key := range []string{"api:b", "api:a", "api:c", "login:a"} {
+		rb.TryAccept(context.Background(), key)
+	}
+
+	var keys struct {
+		Count     int      `json:"count"`
+		Keys      []string `json:"keys"`
+		Truncated bool     `json:"truncated"`
+	}
+	if code := adminRequest(t, handler, http.MethodGet, "/keys?prefix=api:&limit=2", &keys); code != http.StatusOK {
+		t.Fatalf("Unexpected status %d", code)
+	}
+	if keys.Count != 3 || !keys.Truncated || len(keys.Keys) != 2 || keys.Keys[0] != "api:a" || keys.Keys[1] != "api:b" {
+		t.Errorf("Expected the first 2 of 3 keys with the prefix, got %+v", keys)
+	}
+
+	keys.Keys = nil
+	adminRequest(t, handler, http.MethodGet, "/keys?prefix=login:", &keys)
+	if keys.Count != 1 || keys.Truncated || len(keys.Keys) != 1 || keys.Keys[0] != "login:a" {
+		t.Errorf("Expected every key with the prefix, got %+v", keys)
+	}
+}
+
+func TestAdminHandler_BadRequests(t *testing.T) {
+	handler := ratebroker.AdminHandler(ratebroker.NewRateBroker())
+
+	tests := map[string]struct {
+		method, target string
+		status         int
+	}{
+		"missing key":      {http.MethodGet, "/usage", http.StatusBadRequest},
+		"invalid duration": {http.MethodPost, "/ban?key=user1&duration=soon", http.StatusBadRequest},
+		"invalid ban":      {http.MethodPost, "/ban?key=user1&duration=0s", http.StatusBadRequest},
+		"wrong method":     {http.MethodGet, "/reset?key=user1", http.StatusMethodNotAllowed},
+		"invalid limit":    {http.MethodGet, "/keys?limit=0", http.StatusBadRequest},
+	}
+
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var response struct {
+				Error string `json:"error"`
+			}
+			if code := adminRequest(t, handler, tt.method, tt.target, &response); code != tt.status || response.Error == "" {
+				t.Errorf("Expected %d with an error, got %d %+v", tt.status, code, response)
+			}
+		})
+	}
+}
@@ -0,0 +1,4 @@
+// Package checkpb holds the gRPC service of ratebrokerd generated from check.proto.
+package checkpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative check.proto
@@ -8,11 +8,11 @@ import (
 	"os"
 	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	"github.com/kelseyhightower/envconfig"
 	"github.com/parkerroan/ratebroker"
+	"github.com/parkerroan/ratebroker/internal/cmdutil"
 	"github.com/parkerroan/ratebroker/limiter"
 
 	"golang.org/x/exp/slog"
@@ -21,8 +21,39 @@ import (
 type Config struct {
 	Port        int           `envconfig:"SERVER_PORT" default:"8080"`
 	MaxRequests int           `envconfig:"MAX_REQUESTS" default:"5"`
-	Window      time.Duration `envconfig:"WINDOW_DURATION" default:"60s"` // This can be time.Duration if you want the library to handle parsing
-	RedisURL    string        `envconfig:"REDIS_URL" default:"localhost:6379"`
+	Window      time.Duration `envconfig:"WINDOW_DURATION" default:"60s"`      // This can be time.Duration if you want the library to handle parsing
+	RedisURL    string        `envconfig:"REDIS_URL" default:"localhost:6379"` // Comma separated for Sentinel or Cluster
+	// RedisMasterName is the Sentinel master name, setting it connects through Sentinel
+	RedisMasterName string `envconfig:"REDIS_MASTER_NAME"`
+	// Codec selects the stream entry encoding: "fields" (default), "json" or "binary"
+	Codec string `envconfig:"BROKER_CODEC" default:"fields"`
+	// StreamShards spreads the messages over multiple streams
+	StreamShards int `envconfig:"STREAM_SHARDS" default:"1"`
+	// InitLoadOffset replays the stream history on startup, the readiness probe reports ready once it has been replayed
+	InitLoadOffset time.Duration `envconfig:"INIT_LOAD_OFFSET" default:"0s"`
+	// BrokerID identifies this replica, it defaults to the hostname and should be stable across restarts when using a consumer group
+	BrokerID string `envconfig:"BROKER_ID"`
+	// ConsumerGroup consumes the stream with a consumer group per replica so the position survives restarts
+	ConsumerGroup bool `envconfig:"CONSUMER_GROUP" default:"false"`
+	// SigningKeys are comma separated id=secret pairs used to sign broker messages, the first one signs and all of them verify
+	SigningKeys []string `envconfig:"SIGNING_KEYS"`
+	// KeyHashingSecret hashes the keys before they are tracked or broadcast, it must be the same on every replica
+	KeyHashingSecret string `envconfig:"KEY_HASHING_SECRET"`
+	// AccessListFile holds "allow <entry>" and "deny <entry>" lines applied on startup and shared with every replica
+	AccessListFile string `envconfig:"ACCESS_LIST_FILE"`
+	// PenaltyThreshold bans keys rejected more than this many times within the window, zero disables the penalty box
+	PenaltyThreshold int           `envconfig:"PENALTY_THRESHOLD" default:"0"`
+	PenaltyBan       time.Duration `envconfig:"PENALTY_BAN_DURATION" default:"1m"`
+	PenaltyMaxBan    time.Duration `envconfig:"PENALTY_MAX_BAN_DURATION" default:"1h"`
+	// ShadowMode allows every request and only reports the ones that would have been rejected
+	ShadowMode bool `envconfig:"SHADOW_MODE" default:"false"`
+	// HeavyHitters is the number of counters used to track the keys with the most requests, zero disables it
+	HeavyHitters int `envconfig:"HEAVY_HITTERS" default:"100"`
+	// ConfigFile is a YAML or JSON ratebroker config, its limits, policies and lists are reloaded when it changes
+	ConfigFile         string        `envconfig:"CONFIG_FILE"`
+	ConfigPollInterval time.Duration `envconfig:"CONFIG_POLL_INTERVAL" default:"5s"`
+	// AdminPort serves the admin API to inspect and manage keys on a separate port, zero disables it
+	AdminPort int `envconfig:"ADMIN_PORT" default:"0"`
 }
 
 func main() {
@@ -38,24 +69,93 @@ func main() {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
-	rdb := redis.NewClient(&redis.Options{
-		Addr: cfg.RedisURL, // "localhost:6379"
-	})
+	rdb := cmdutil.NewRedisClient(cfg.RedisURL, cfg.RedisMasterName)
+
+	cfg.BrokerID, err = cmdutil.BrokerID(cfg.BrokerID)
+	if err != nil {
+		log.Fatalf("Error reading hostname: %v", err)
+	}
+
+	// Metrics of the rate broker and the Redis broker, served on /metrics
+	metrics := ratebroker.NewPrometheusMetrics()
+
+	brokerOpts := []func(*ratebroker.RedisMessageBroker){
+		ratebroker.WithBrokerMetrics(metrics),
+		ratebroker.WithInitLoadOffset(cfg.InitLoadOffset),
+		ratebroker.WithShards(cfg.StreamShards),
+	}
+	switch cfg.Codec {
+	case "json":
+		brokerOpts = append(brokerOpts, ratebroker.WithCodec(ratebroker.JSONCodec{}))
+	case "binary":
+		brokerOpts = append(brokerOpts, ratebroker.WithCodec(ratebroker.BinaryCodec{}))
+	}
+	if cfg.ConsumerGroup {
+		brokerOpts = append(brokerOpts, ratebroker.WithConsumerGroup(cfg.BrokerID))
+	}
+
+	// The broker options of the config file override the environment
+	if cfg.ConfigFile != "" {
+		fileBrokerOpts, err := cmdutil.LoadBrokerOptions(cfg.ConfigFile)
+		if err != nil {
+			log.Fatalf("Error loading config file: %v", err)
+		}
+		brokerOpts = append(brokerOpts, fileBrokerOpts...)
+	}
 
 	// Create instances of your broker and limiter
-	redisBroker := ratebroker.NewRedisMessageBroker(rdb)
+	redisBroker := ratebroker.NewRedisMessageBroker(rdb, brokerOpts...)
 
-	// Create a rate broker w/ ring limiter
-	rateBroker := ratebroker.NewRateBroker(
+	broker, err := cmdutil.WithSigningKeys(redisBroker, cfg.SigningKeys)
+	if err != nil {
+		log.Fatalf("Error loading signing keys: %v", err)
+	}
+
+	rateBrokerOpts := []ratebroker.Option{
 		ratebroker.WithLimiterContructorFunc(limiter.NewRingLimiterConstructorFunc()),
-		ratebroker.WithBroker(redisBroker),
+		ratebroker.WithBroker(broker),
+		ratebroker.WithID(cfg.BrokerID),
 		ratebroker.WithMaxRequests(cfg.MaxRequests),
 		ratebroker.WithWindow(cfg.Window),
-	)
+		ratebroker.WithMetrics(metrics),
+	}
+	if cfg.KeyHashingSecret != "" {
+		rateBrokerOpts = append(rateBrokerOpts, ratebroker.WithKeyHashing([]byte(cfg.KeyHashingSecret)))
+	}
+	if cfg.ShadowMode {
+		rateBrokerOpts = append(rateBrokerOpts, ratebroker.WithShadowMode(nil))
+	}
+	if cfg.HeavyHitters > 0 {
+		rateBrokerOpts = append(rateBrokerOpts, ratebroker.WithHeavyHitters(cfg.HeavyHitters))
+	}
+	if cfg.PenaltyThreshold > 0 {
+		rateBrokerOpts = append(rateBrokerOpts, ratebroker.WithPenaltyBox(ratebroker.PenaltyBox{
+			Threshold:      cfg.PenaltyThreshold,
+			Period:         cfg.Window,
+			BanDuration:    cfg.PenaltyBan,
+			MaxBanDuration: cfg.PenaltyMaxBan,
+		}))
+	}
+
+	// Create a rate broker w/ ring limiter
+	rateBroker := ratebroker.NewRateBroker(rateBrokerOpts...)
 
 	ctx := context.Background()
+
+	if cfg.ConfigFile != "" {
+		if err := rateBroker.WatchConfigFile(ctx, cfg.ConfigFile, cfg.ConfigPollInterval); err != nil {
+			log.Fatalf("Error loading config file: %v", err)
+		}
+	}
+
 	rateBroker.Start(ctx)
 
+	if cfg.AccessListFile != "" {
+		if err := rateBroker.LoadAccessListFile(ctx, cfg.AccessListFile); err != nil {
+			log.Fatalf("Error loading access list: %v", err)
+		}
+	}
+
 	// This function generates a key (in this case, the client's IP address)
 	// that the rate limiter uses to identify unique clients.
 	keyGetter := func(r *http.Request) string {
@@ -77,14 +177,28 @@ func main() {
 	// Add the logging middleware for gorilla/mux
 	r.Use(LoggingMiddleware)
 
+	// Readiness and health probes, registered outside of the rate limited routes
+	r.Handle("/readyz", ratebroker.ReadinessHandler(rateBroker))
+	r.Handle("/healthz", ratebroker.HealthHandler(rateBroker))
+	r.Handle("/metrics", metrics.Handler(rateBroker))
+
+	// Subrouter for the rate limited routes
+	api := r.PathPrefix("/").Subrouter()
+
 	// Middleware to rate limit requests for gorilla/mux
-	r.Use(ratebroker.HttpMiddleware(rateBroker, keyGetter))
+	api.Use(ratebroker.HttpMiddleware(rateBroker, keyGetter))
 
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	api.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		// Handle the request, i.e., serve content, call other functions, etc.
 		w.Write([]byte("Hello, World!"))
 	})
 
+	if cfg.AdminPort != 0 {
+		go func() {
+			log.Fatal(cmdutil.NewAdminServer(cfg.AdminPort, ratebroker.AdminHandler(rateBroker)).ListenAndServe())
+		}()
+	}
+
 	// // Add the logging middleware first for net/http
 	// wrappedHandler := LoggingMiddleware(r)
 
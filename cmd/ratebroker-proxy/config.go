@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/parkerroan/ratebroker"
+	"gopkg.in/yaml.v3"
+)
+
+var errInvalidProxyConfig = errors.New("invalid proxy config")
+
+// proxyConfig is the YAML or JSON file of the routes of the proxy and their limits.
+type proxyConfig struct {
+	Routes []routeConfig `json:"routes" yaml:"routes"`
+	// RateBroker holds the default limits, policies and lists, the route limits are added to its policies
+	RateBroker ratebroker.Config `json:"ratebroker,omitempty" yaml:"ratebroker,omitempty"`
+}
+
+// routeConfig forwards the requests matching Path to Upstream, rate limited by the key
+// extracted from each request within the route's policy.
+type routeConfig struct {
+	// Path is an http.ServeMux pattern, e.g. "/api/" for every path under /api or "example.com/" for a host
+	Path     string `json:"path" yaml:"path"`
+	Upstream string `json:"upstream" yaml:"upstream"`
+	// Policy namespaces the keys of the route as "policy:key", it defaults to the path so every route has its own limits
+	Policy string `json:"policy,omitempty" yaml:"policy,omitempty"`
+	// MaxRequests and Window set the limit of the policy, the ratebroker policies and defaults apply without them
+	MaxRequests int                 `json:"max_requests,omitempty" yaml:"max_requests,omitempty"`
+	Window      ratebroker.Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	// Key lists the key extraction rules, the first one to find a value wins and the client IP is the fallback
+	Key []string `json:"key,omitempty" yaml:"key,omitempty"`
+}
+
+// loadProxyConfig reads the proxy config file at path, as JSON when its extension is
+// .json and as YAML otherwise. Unknown fields are rejected.
+func loadProxyConfig(path string) (*proxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg proxyConfig
+	if strings.ToLower(filepath.Ext(path)) == ".json" {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&cfg)
+	} else {
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&cfg); errors.Is(err, io.EOF) {
+			err = nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", errInvalidProxyConfig, path, err)
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// validate checks the routes and sets their default policy.
+func (c *proxyConfig) validate() error {
+	if len(c.Routes) == 0 {
+		return fmt.Errorf("%w: at least one route is required", errInvalidProxyConfig)
+	}
+
+	paths := make(map[string]bool, len(c.Routes))
+	for i := range c.Routes {
+		route := &c.Routes[i]
+		if route.Path == "" || paths[route.Path] {
+			return fmt.Errorf("%w: route %d needs a unique path", errInvalidProxyConfig, i)
+		}
+		paths[route.Path] = true
+
+		if _, err := route.upstreamURL(); err != nil {
+			return fmt.Errorf("%w: route %q: %v", errInvalidProxyConfig, route.Path, err)
+		}
+		if (route.MaxRequests > 0) != (route.Window > 0) || route.MaxRequests < 0 || route.Window < 0 {
+			return fmt.Errorf("%w: route %q needs both a positive max_requests and window, or neither", errInvalidProxyConfig, route.Path)
+		}
+		if _, err := newKeyGetter(route.Key); err != nil {
+			return fmt.Errorf("%w: route %q: %v", errInvalidProxyConfig, route.Path, err)
+		}
+
+		if route.Policy == "" {
+			route.Policy = route.Path
+		}
+	}
+	return nil
+}
+
+// rateBrokerConfig returns the ratebroker config with a policy for every route with a limit.
+func (c *proxyConfig) rateBrokerConfig() *ratebroker.Config {
+	cfg := c.RateBroker
+	cfg.Policies = append([]ratebroker.PolicyConfig{}, cfg.Policies...)
+	for _, route := range c.Routes {
+		if route.MaxRequests > 0 {
+			cfg.Policies = append(cfg.Policies, ratebroker.PolicyConfig{
+				Key:         route.Policy + ":*",
+				MaxRequests: route.MaxRequests,
+				Window:      route.Window,
+			})
+		}
+	}
+	return &cfg
+}
+
+func (r routeConfig) upstreamURL() (*url.URL, error) {
+	upstream, err := url.Parse(r.Upstream)
+	if err != nil {
+		return nil, err
+	}
+	if upstream.Scheme != "http" && upstream.Scheme != "https" || upstream.Host == "" {
+		return nil, fmt.Errorf("upstream %q must be an absolute http or https URL", r.Upstream)
+	}
+	return upstream, nil
+}
+
+// newProxyHandler routes the requests to the upstreams of the config, each route behind
+// ratebroker.HttpMiddleware with its own policy and key extraction rules.
+func newProxyHandler(rb *ratebroker.RateBroker, cfg *proxyConfig) (http.Handler, error) {
+	mux := http.NewServeMux()
+	for _, route := range cfg.Routes {
+		upstream, err := route.upstreamURL()
+		if err != nil {
+			return nil, err
+		}
+		keyGetter, err := newKeyGetter(route.Key)
+		if err != nil {
+			return nil, err
+		}
+
+		policy := route.Policy
+		proxy := &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(upstream)
+				r.SetXForwarded()
+			},
+		}
+		limit := ratebroker.HttpMiddleware(rb, func(r *http.Request) string {
+			return policy + ":" + keyGetter(r)
+		})
+		mux.Handle(route.Path, limit(proxy))
+	}
+	return mux, nil
+}
+
+// newKeyGetter parses key extraction rules:
+//
+//	ip               the client IP address
+//	forwarded        the last address of the X-Forwarded-For header, added by the load balancer in front of the proxy
+//	forwarded:N      the Nth address from the end of the header, for N trusted proxies in front of the proxy
+//	header:NAME      the value of a request header, e.g. header:X-API-Key
+//	query:NAME       the value of a query parameter
+//	cookie:NAME      the value of a cookie
+//
+// The key is the value of the first rule that finds one, and the client IP otherwise.
+func newKeyGetter(rules []string) (func(r *http.Request) string, error) {
+	getters := make([]func(r *http.Request) string, 0, len(rules))
+	for _, rule := range rules {
+		kind, name, hasName := strings.Cut(rule, ":")
+		if (kind == "header" || kind == "query" || kind == "cookie") && name == "" {
+			return nil, fmt.Errorf("key rule %q needs a name", rule)
+		}
+
+		switch kind {
+		case "ip":
+			getters = append(getters, clientIP)
+		case "forwarded":
+			hops := 1
+			if hasName {
+				var err error
+				if hops, err = strconv.Atoi(name); err != nil || hops < 1 {
+					return nil, fmt.Errorf("key rule %q needs a positive number of trusted proxies", rule)
+				}
+			}
+			getters = append(getters, func(r *http.Request) string {
+				return forwardedFor(r, hops)
+			})
+		case "header":
+			getters = append(getters, func(r *http.Request) string {
+				return r.Header.Get(name)
+			})
+		case "query":
+			getters = append(getters, func(r *http.Request) string {
+				return r.URL.Query().Get(name)
+			})
+		case "cookie":
+			getters = append(getters, func(r *http.Request) string {
+				cookie, err := r.Cookie(name)
+				if err != nil {
+					return ""
+				}
+				return cookie.Value
+			})
+		default:
+			return nil, fmt.Errorf("unknown key rule %q", rule)
+		}
+	}
+
+	return func(r *http.Request) string {
+		for _, getter := range getters {
+			if key := getter(r); key != "" {
+				return key
+			}
+		}
+		return clientIP(r)
+	}, nil
+}
+
+// forwardedFor returns the address added to the X-Forwarded-For header by the
+// outermost of the trusted proxies in front of this one. Clients can set the header
+// themselves, so the addresses before it cannot be trusted.
+func forwardedFor(r *http.Request, trustedProxies int) string {
+	var addresses []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		addresses = append(addresses, strings.Split(header, ",")...)
+	}
+	if len(addresses) < trustedProxies {
+		return ""
+	}
+	return strings.TrimSpace(addresses[len(addresses)-trustedProxies])
+}
+
+// clientIP returns the IP address of the client connected to the proxy.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,188 @@
+//go:build unit
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+func TestLoadProxyConfig(t *testing.T) {
+	cfg, err := loadProxyConfig("proxy.example.yaml")
+	if err != nil {
+		t.Fatalf("Unexpected error loading the example config: %v", err)
+	}
+	if len(cfg.Routes) != 3 || cfg.Routes[2].Policy != "/" {
+		t.Errorf("Expected 3 routes with the path as the default policy, got %+v", cfg.Routes)
+	}
+
+	policies := cfg.rateBrokerConfig().Policies
+	if len(policies) != 2 || policies[0].Key != "api:*" || policies[1].Key != "login:*" || policies[1].MaxRequests != 5 {
+		t.Errorf("Expected a policy for each route with a limit, got %+v", policies)
+	}
+
+	tests := map[string]string{
+		"no routes":         `routes: []`,
+		"missing upstream":  "routes:\n  - path: /\n",
+		"relative upstream": "routes:\n  - path: /\n    upstream: /api\n",
+		"duplicate path":    "routes:\n  - path: /\n    upstream: http://a\n  - path: /\n    upstream: http://b\n",
+		"limit no window":   "routes:\n  - path: /\n    upstream: http://a\n    max_requests: 1\n",
+		"unknown key rule":  "routes:\n  - path: /\n    upstream: http://a\n    key: [\"body\"]\n",
+		"unnamed header":    "routes:\n  - path: /\n    upstream: http://a\n    key: [\"header\"]\n",
+		"invalid hops":      "routes:\n  - path: /\n    upstream: http://a\n    key: [\"forwarded:0\"]\n",
+		"unknown field":     "routes:\n  - path: /\n    upstream: http://a\n    upstreams: [http://b]\n",
+	}
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "proxy.yaml")
+			if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadProxyConfig(path); err == nil {
+				t.Error("Expected an error")
+			}
+		})
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream-Path", r.URL.Path)
+	}))
+	defer upstream.Close()
+
+	cfg := &proxyConfig{
+		Routes: []routeConfig{
+			{Path: "/api/", Upstream: upstream.URL, MaxRequests: 1, Window: ratebroker.Duration(time.Minute), Key: []string{"header:X-API-Key"}},
+			{Path: "/", Upstream: upstream.URL},
+		},
+		RateBroker: ratebroker.Config{MaxRequests: 2, Window: ratebroker.Duration(time.Minute)},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Unexpected error validating config: %v", err)
+	}
+
+	rb := ratebroker.NewRateBroker()
+	if err := rb.ApplyConfig(cfg.rateBrokerConfig()); err != nil {
+		t.Fatalf("Unexpected error applying config: %v", err)
+	}
+	handler, err := newProxyHandler(rb, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating proxy: %v", err)
+	}
+
+	request := func(path, apiKey string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if apiKey != "" {
+			req.Header.Set("X-API-Key", apiKey)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("/api/users", "key1"); rec.Code != http.StatusOK || rec.Header().Get("X-Upstream-Path") != "/api/users" {
+		t.Fatalf("Expected the request to be proxied, got %d %v", rec.Code, rec.Header())
+	}
+	if rec := request("/api/users", "key1"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the api route limit to be enforced per API key, got %d", rec.Code)
+	}
+	if rec := request("/api/users", "key2"); rec.Code != http.StatusOK {
+		t.Errorf("Expected another API key to have its own limit, got %d", rec.Code)
+	}
+
+	// The other route has the default limit and its own keys, by client IP
+	for i := 0; i < 2; i++ {
+		if rec := request("/", ""); rec.Code != http.StatusOK {
+			t.Fatalf("Expected request %d to be proxied, got %d", i, rec.Code)
+		}
+	}
+	if rec := request("/", ""); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected the default limit to be enforced, got %d", rec.Code)
+	}
+}
+
+func TestProxyHandler_AccessLists(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	cfg := &proxyConfig{
+		Routes: []routeConfig{{Path: "/", Upstream: upstream.URL, Policy: "web", Key: []string{"forwarded"}}},
+		RateBroker: ratebroker.Config{
+			MaxRequests: 1,
+			Window:      ratebroker.Duration(time.Minute),
+			Allow:       []string{"10.0.0.0/8"},
+			Deny:        []string{"203.0.113.0/24"},
+		},
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatalf("Unexpected error validating config: %v", err)
+	}
+
+	rb := ratebroker.NewRateBroker()
+	if err := rb.ApplyConfig(cfg.rateBrokerConfig()); err != nil {
+		t.Fatalf("Unexpected error applying config: %v", err)
+	}
+	handler, err := newProxyHandler(rb, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error creating proxy: %v", err)
+	}
+
+	request := func(client string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-Forwarded-For", client)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// The ranges match the addresses namespaced by the policy of the route
+	for i := 0; i < 3; i++ {
+		if code := request("10.1.2.3"); code != http.StatusOK {
+			t.Fatalf("Expected request %d from the allowed range to be proxied, got %d", i, code)
+		}
+	}
+	if code := request("203.0.113.7"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected the denied range to be rejected, got %d", code)
+	}
+}
+
+func TestKeyGetter(t *testing.T) {
+	getter, err := newKeyGetter([]string{"header:X-API-Key", "cookie:session", "query:token", "forwarded"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?token=t1", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	if key := getter(req); key != "s1" {
+		t.Errorf("Expected the first rule with a value to win, got %q", key)
+	}
+
+	// The client can set the first addresses, only the one added by the load balancer is trusted
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+	if key := getter(req); key != "10.0.0.1" {
+		t.Errorf("Expected the last forwarded address, got %q", key)
+	}
+
+	twoHops, err := newKeyGetter([]string{"forwarded:2"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	req.Header.Add("X-Forwarded-For", "10.0.0.2")
+	if key := twoHops(req); key != "10.0.0.1" {
+		t.Errorf("Expected the address added by the outermost trusted proxy, got %q", key)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	if key := getter(req); key != "192.0.2.1" {
+		t.Errorf("Expected the client IP as the fallback, got %q", key)
+	}
+}
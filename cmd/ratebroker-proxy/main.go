@@ -0,0 +1,129 @@
+// Command ratebroker-proxy is a reverse proxy that rate limits the requests to its
+// upstreams with a RateBroker. Its routes, their upstreams, limits and key extraction
+// rules are read from the file set with PROXY_CONFIG, see proxy.example.yaml.
+//
+// Every replica shares its limits with the others through Redis, so a fleet of proxies
+// enforces the same distributed limits.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kelseyhightower/envconfig"
+	"github.com/parkerroan/ratebroker"
+	"github.com/parkerroan/ratebroker/internal/cmdutil"
+	"golang.org/x/sync/errgroup"
+)
+
+type Config struct {
+	HTTPPort int `envconfig:"HTTP_PORT" default:"8080"`
+	// AdminPort serves the admin API, metrics and probes off the proxied port, zero disables it
+	AdminPort int `envconfig:"ADMIN_PORT" default:"8081"`
+	// ProxyConfig is the YAML or JSON file of the routes
+	ProxyConfig string        `envconfig:"PROXY_CONFIG" required:"true"`
+	MaxRequests int           `envconfig:"MAX_REQUESTS" default:"30"`
+	Window      time.Duration `envconfig:"WINDOW_DURATION" default:"10s"`
+	RedisURL    string        `envconfig:"REDIS_URL" default:"localhost:6379"` // Comma separated for Sentinel or Cluster
+	// RedisMasterName is the Sentinel master name, setting it connects through Sentinel
+	RedisMasterName string `envconfig:"REDIS_MASTER_NAME"`
+	// BrokerID identifies this replica, it defaults to the hostname
+	BrokerID string `envconfig:"BROKER_ID"`
+}
+
+func main() {
+	var cfg Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	brokerID, err := cmdutil.BrokerID(cfg.BrokerID)
+	if err != nil {
+		log.Fatalf("Error reading hostname: %v", err)
+	}
+	cfg.BrokerID = brokerID
+
+	proxyCfg, err := loadProxyConfig(cfg.ProxyConfig)
+	if err != nil {
+		log.Fatalf("Error loading proxy config: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	metrics := ratebroker.NewPrometheusMetrics()
+	rateBroker := newRateBroker(cfg, proxyCfg, metrics)
+	if err := rateBroker.ApplyConfig(proxyCfg.rateBrokerConfig()); err != nil {
+		log.Fatalf("Error applying proxy config: %v", err)
+	}
+	rateBroker.Start(ctx)
+
+	proxy, err := newProxyHandler(rateBroker, proxyCfg)
+	if err != nil {
+		log.Fatalf("Error creating proxy: %v", err)
+	}
+
+	servers := []*http.Server{{Addr: fmt.Sprintf(":%d", cfg.HTTPPort), Handler: proxy}}
+	if cfg.AdminPort != 0 {
+		admin := http.NewServeMux()
+		admin.Handle("/", ratebroker.AdminHandler(rateBroker))
+		admin.Handle("/readyz", ratebroker.ReadinessHandler(rateBroker))
+		admin.Handle("/healthz", ratebroker.HealthHandler(rateBroker))
+		admin.Handle("/metrics", metrics.Handler(rateBroker))
+		servers = append(servers, cmdutil.NewAdminServer(cfg.AdminPort, admin))
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	for _, server := range servers {
+		server := server
+		group.Go(func() error {
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+
+	// Shut down on a signal or as soon as a server fails
+	group.Go(func() error {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			server.Shutdown(shutdownCtx)
+		}
+		return nil
+	})
+
+	if err := group.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newRateBroker creates the RateBroker and its Redis broker from the config.
+func newRateBroker(cfg Config, proxyCfg *proxyConfig, metrics *ratebroker.PrometheusMetrics) *ratebroker.RateBroker {
+	rdb := cmdutil.NewRedisClient(cfg.RedisURL, cfg.RedisMasterName)
+
+	// The stream, shards and codec are set by the ratebroker section of the proxy config
+	brokerOpts, err := proxyCfg.RateBroker.Broker.Options()
+	if err != nil {
+		log.Fatalf("Error loading proxy config: %v", err)
+	}
+	brokerOpts = append(brokerOpts, ratebroker.WithBrokerMetrics(metrics))
+
+	return ratebroker.NewRateBroker(
+		ratebroker.WithBroker(ratebroker.NewRedisMessageBroker(rdb, brokerOpts...)),
+		ratebroker.WithID(cfg.BrokerID),
+		ratebroker.WithMaxRequests(cfg.MaxRequests),
+		ratebroker.WithWindow(cfg.Window),
+		ratebroker.WithMetrics(metrics),
+	)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+	"github.com/parkerroan/ratebroker/checkpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var (
+	errMissingKey   = errors.New("key is required")
+	errNegativeCost = errors.New("cost cannot be negative")
+)
+
+// checkServer serves the check API of a RateBroker over HTTP/JSON and gRPC.
+type checkServer struct {
+	checkpb.UnimplementedCheckServiceServer
+	rb *ratebroker.RateBroker
+}
+
+// checkRequest is the JSON body of POST /v1/check, see checkpb.CheckRequest.
+type checkRequest struct {
+	Key    string `json:"key"`
+	Cost   int    `json:"cost"`
+	Policy string `json:"policy"`
+}
+
+// checkResponse is the JSON response of POST /v1/check, see checkpb.CheckResponse.
+type checkResponse struct {
+	Allowed     bool                `json:"allowed"`
+	Decision    string              `json:"decision"`
+	MaxRequests int                 `json:"max_requests"`
+	Window      ratebroker.Duration `json:"window"`
+	BannedUntil *time.Time          `json:"banned_until,omitempty"`
+	WouldReject bool                `json:"would_reject"`
+}
+
+// check validates the request and checks it against the limit of the key in the policy.
+func (s *checkServer) check(ctx context.Context, key string, cost int, policy string) (ratebroker.CheckResult, error) {
+	if key == "" {
+		return ratebroker.CheckResult{}, errMissingKey
+	}
+	if cost < 0 {
+		return ratebroker.CheckResult{}, errNegativeCost
+	}
+
+	// Namespacing the key lets the policies of the config file match it by prefix
+	if policy != "" {
+		key = policy + ":" + key
+	}
+	return s.rb.Check(ctx, key, cost), nil
+}
+
+// Check implements checkpb.CheckServiceServer.
+func (s *checkServer) Check(ctx context.Context, req *checkpb.CheckRequest) (*checkpb.CheckResponse, error) {
+	result, err := s.check(ctx, req.GetKey(), int(req.GetCost()), req.GetPolicy())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	details := &checkpb.LimitDetails{
+		MaxRequests: int32(result.MaxRequests),
+		Window:      durationpb.New(result.Window),
+		WouldReject: result.WouldReject,
+	}
+	if !result.BannedUntil.IsZero() {
+		details.BannedUntil = timestamppb.New(result.BannedUntil)
+	}
+
+	return &checkpb.CheckResponse{
+		Allowed:      result.Allowed,
+		Decision:     result.Decision,
+		LimitDetails: details,
+	}, nil
+}
+
+// ServeHTTP serves POST /v1/check with a checkRequest body.
+func (s *checkServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	var req checkRequest
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request: " + err.Error()})
+		return
+	}
+
+	result, err := s.check(r.Context(), req.Key, req.Cost, req.Policy)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	response := checkResponse{
+		Allowed:     result.Allowed,
+		Decision:    result.Decision,
+		MaxRequests: result.MaxRequests,
+		Window:      ratebroker.Duration(result.Window),
+		WouldReject: result.WouldReject,
+	}
+	if !result.BannedUntil.IsZero() {
+		response.BannedUntil = &result.BannedUntil
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,110 @@
+//go:build unit
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+	"github.com/parkerroan/ratebroker/checkpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newCheckServer(t *testing.T) *checkServer {
+	cfg := &ratebroker.Config{
+		MaxRequests: 2,
+		Window:      ratebroker.Duration(time.Minute),
+		Policies:    []ratebroker.PolicyConfig{{Key: "login:*", MaxRequests: 1, Window: ratebroker.Duration(time.Minute)}},
+	}
+	rb := ratebroker.NewRateBroker()
+	if err := rb.ApplyConfig(cfg); err != nil {
+		t.Fatalf("Unexpected error applying config: %v", err)
+	}
+	return &checkServer{rb: rb}
+}
+
+func TestCheckServer_HTTP(t *testing.T) {
+	server := newCheckServer(t)
+
+	check := func(body string) (int, checkResponse) {
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/check", strings.NewReader(body)))
+
+		var response checkResponse
+		json.NewDecoder(rec.Body).Decode(&response)
+		return rec.Code, response
+	}
+
+	if code, response := check(`{"key": "user1", "cost": 2}`); code != http.StatusOK || !response.Allowed || response.Decision != ratebroker.DecisionAccepted || response.MaxRequests != 2 {
+		t.Errorf("Expected the request to be accepted, got %d %+v", code, response)
+	}
+	if _, response := check(`{"key": "user1"}`); response.Allowed || response.Decision != ratebroker.DecisionRejected {
+		t.Errorf("Expected the cost to count towards the limit, got %+v", response)
+	}
+
+	if _, response := check(`{"key": "user1", "policy": "login"}`); !response.Allowed || response.MaxRequests != 1 {
+		t.Errorf("Expected the login policy to apply to its own key, got %+v", response)
+	}
+	if _, response := check(`{"key": "user1", "policy": "login"}`); response.Allowed {
+		t.Errorf("Expected the login policy to be enforced, got %+v", response)
+	}
+
+	for _, body := range []string{`{"cost": 1}`, `{"key": "user1", "cost": -1}`, `{"key": "user1", "weight": 1}`, `not json`} {
+		if code, _ := check(body); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for %s, got %d", body, code)
+		}
+	}
+}
+
+func TestCheckServer_GRPC(t *testing.T) {
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	checkpb.RegisterCheckServiceServer(grpcServer, newCheckServer(t))
+	go grpcServer.Serve(listener)
+	defer grpcServer.Stop()
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	defer conn.Close()
+
+	client := checkpb.NewCheckServiceClient(conn)
+	ctx := context.Background()
+
+	response, err := client.Check(ctx, &checkpb.CheckRequest{Key: "user1", Policy: "login"})
+	if err != nil {
+		t.Fatalf("Unexpected error checking: %v", err)
+	}
+	if !response.GetAllowed() || response.GetDecision() != ratebroker.DecisionAccepted {
+		t.Errorf("Expected the request to be accepted, got %v", response)
+	}
+	if details := response.GetLimitDetails(); details.GetMaxRequests() != 1 || details.GetWindow().AsDuration() != time.Minute {
+		t.Errorf("Expected the limit of the login policy, got %v", details)
+	}
+
+	response, err = client.Check(ctx, &checkpb.CheckRequest{Key: "user1", Policy: "login"})
+	if err != nil || response.GetAllowed() {
+		t.Errorf("Expected the request over the limit to be rejected, got %v %v", response, err)
+	}
+
+	if _, err := client.Check(ctx, &checkpb.CheckRequest{}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Expected InvalidArgument without a key, got %v", err)
+	}
+}
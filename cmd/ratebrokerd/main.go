@@ -0,0 +1,165 @@
+// Command ratebrokerd hosts a RateBroker and exposes its decisions to services in
+// any language, over HTTP/JSON on POST /v1/check and over gRPC, see checkpb. Its gRPC
+// server also implements Envoy's rate limit service, see envoyrls.
+//
+// Every replica shares its limits with the others through Redis, like the RateBrokers
+// embedded in Go services, so they can all enforce the same distributed limits.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/kelseyhightower/envconfig"
+	"github.com/parkerroan/ratebroker"
+	"github.com/parkerroan/ratebroker/checkpb"
+	"github.com/parkerroan/ratebroker/envoyrls"
+	"github.com/parkerroan/ratebroker/internal/cmdutil"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/grpc"
+)
+
+type Config struct {
+	HTTPPort int `envconfig:"HTTP_PORT" default:"8080"`
+	GRPCPort int `envconfig:"GRPC_PORT" default:"9090"`
+	// AdminPort serves the admin API to inspect and manage keys, zero disables it
+	AdminPort   int           `envconfig:"ADMIN_PORT" default:"0"`
+	MaxRequests int           `envconfig:"MAX_REQUESTS" default:"30"`
+	Window      time.Duration `envconfig:"WINDOW_DURATION" default:"10s"`
+	RedisURL    string        `envconfig:"REDIS_URL" default:"localhost:6379"` // Comma separated for Sentinel or Cluster
+	// RedisMasterName is the Sentinel master name, setting it connects through Sentinel
+	RedisMasterName string `envconfig:"REDIS_MASTER_NAME"`
+	// BrokerID identifies this replica, it defaults to the hostname and should be stable across restarts when using a consumer group
+	BrokerID string `envconfig:"BROKER_ID"`
+	// ConsumerGroup consumes the stream with a consumer group per replica so the position survives restarts
+	ConsumerGroup bool `envconfig:"CONSUMER_GROUP" default:"false"`
+	// InitLoadOffset replays the stream history on startup, the readiness probe reports ready once it has been replayed
+	InitLoadOffset time.Duration `envconfig:"INIT_LOAD_OFFSET" default:"0s"`
+	// SigningKeys are comma separated id=secret pairs used to sign broker messages, the first one signs and all of them verify
+	SigningKeys []string `envconfig:"SIGNING_KEYS"`
+	// ConfigFile is a YAML or JSON ratebroker config, its policies match the checked keys prefixed by their policy, e.g. "login:*"
+	ConfigFile         string        `envconfig:"CONFIG_FILE"`
+	ConfigPollInterval time.Duration `envconfig:"CONFIG_POLL_INTERVAL" default:"5s"`
+}
+
+func main() {
+	var cfg Config
+	if err := envconfig.Process("", &cfg); err != nil {
+		log.Fatalf("Error loading config: %v", err)
+	}
+
+	brokerID, err := cmdutil.BrokerID(cfg.BrokerID)
+	if err != nil {
+		log.Fatalf("Error reading hostname: %v", err)
+	}
+	cfg.BrokerID = brokerID
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	metrics := ratebroker.NewPrometheusMetrics()
+	rateBroker := newRateBroker(cfg, metrics)
+
+	if cfg.ConfigFile != "" {
+		if err := rateBroker.WatchConfigFile(ctx, cfg.ConfigFile, cfg.ConfigPollInterval); err != nil {
+			log.Fatalf("Error loading config file: %v", err)
+		}
+	}
+	rateBroker.Start(ctx)
+
+	checks := &checkServer{rb: rateBroker}
+
+	mux := http.NewServeMux()
+	mux.Handle("/v1/check", checks)
+	mux.Handle("/readyz", ratebroker.ReadinessHandler(rateBroker))
+	mux.Handle("/healthz", ratebroker.HealthHandler(rateBroker))
+	mux.Handle("/metrics", metrics.Handler(rateBroker))
+
+	grpcServer := grpc.NewServer()
+	checkpb.RegisterCheckServiceServer(grpcServer, checks)
+	rlsv3.RegisterRateLimitServiceServer(grpcServer, envoyrls.NewServer(rateBroker))
+
+	servers := []*http.Server{{Addr: fmt.Sprintf(":%d", cfg.HTTPPort), Handler: mux}}
+	if cfg.AdminPort != 0 {
+		servers = append(servers, cmdutil.NewAdminServer(cfg.AdminPort, ratebroker.AdminHandler(rateBroker)))
+	}
+
+	group, ctx := errgroup.WithContext(ctx)
+	for _, server := range servers {
+		server := server
+		group.Go(func() error {
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		})
+	}
+	group.Go(func() error {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.GRPCPort))
+		if err != nil {
+			return err
+		}
+		return grpcServer.Serve(listener)
+	})
+
+	// Shut down on a signal or as soon as a server fails
+	group.Go(func() error {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, server := range servers {
+			server.Shutdown(shutdownCtx)
+		}
+		grpcServer.GracefulStop()
+		return nil
+	})
+
+	if err := group.Wait(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newRateBroker creates the RateBroker and its Redis broker from the config.
+func newRateBroker(cfg Config, metrics *ratebroker.PrometheusMetrics) *ratebroker.RateBroker {
+	rdb := cmdutil.NewRedisClient(cfg.RedisURL, cfg.RedisMasterName)
+
+	brokerOpts := []func(*ratebroker.RedisMessageBroker){
+		ratebroker.WithBrokerMetrics(metrics),
+		ratebroker.WithInitLoadOffset(cfg.InitLoadOffset),
+	}
+	if cfg.ConsumerGroup {
+		brokerOpts = append(brokerOpts, ratebroker.WithConsumerGroup(cfg.BrokerID))
+	}
+
+	// The stream, shards and codec are set by the config file
+	if cfg.ConfigFile != "" {
+		fileBrokerOpts, err := cmdutil.LoadBrokerOptions(cfg.ConfigFile)
+		if err != nil {
+			log.Fatalf("Error loading config file: %v", err)
+		}
+		brokerOpts = append(brokerOpts, fileBrokerOpts...)
+	}
+
+	broker, err := cmdutil.WithSigningKeys(ratebroker.NewRedisMessageBroker(rdb, brokerOpts...), cfg.SigningKeys)
+	if err != nil {
+		log.Fatalf("Error loading signing keys: %v", err)
+	}
+
+	return ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithID(cfg.BrokerID),
+		ratebroker.WithMaxRequests(cfg.MaxRequests),
+		ratebroker.WithWindow(cfg.Window),
+		ratebroker.WithMetrics(metrics),
+	)
+}
@@ -0,0 +1,396 @@
+package ratebroker
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Codec encodes a Message into a single payload and back. Brokers that support a
+// Codec, e.g. RedisMessageBroker with WithCodec, send the payload instead of their
+// default encoding. Every replica must use the same Codec.
+type Codec interface {
+	Encode(Message) ([]byte, error)
+	Decode([]byte) (Message, error)
+}
+
+// ErrMalformedPayload is returned when a payload cannot be decoded by a Codec.
+var ErrMalformedPayload = errors.New("malformed payload")
+
+// ErrUnhashedKey is returned by a BinaryCodec with HashKeys when the key of an event
+// is not a hash, see BinaryCodec.
+var ErrUnhashedKey = errors.New("key is not hashed")
+
+// JSONCodec encodes a Message as JSON using its struct tags.
+type JSONCodec struct{}
+
+// Encode encodes the message as JSON.
+func (JSONCodec) Encode(msg Message) ([]byte, error) {
+	return json.Marshal(msg)
+}
+
+// Decode decodes a message encoded as JSON.
+func (JSONCodec) Decode(data []byte) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return Message{}, fmt.Errorf("%w: %v", ErrMalformedPayload, err)
+	}
+	return msg, nil
+}
+
+// binaryCodecVersion is the first byte of every payload encoded by the BinaryCodec.
+// Payloads with fields beyond the first flags byte, e.g. a count, start with
+// binaryCodecExtendedVersion and a second flags byte, so that the others can still be
+// decoded by replicas that only know the first version.
+const (
+	binaryCodecVersion         = 1
+	binaryCodecExtendedVersion = 2
+)
+
+// Flags describing how the fields of a BinaryCodec payload are encoded.
+const (
+	binaryFlagUUIDBrokerID = 1 << iota // The broker ID is a UUID stored as 16 bytes
+	binaryFlagHashedKey                // The key is a 64 bit hash stored as 8 bytes, see BinaryCodec.HashKeys
+	binaryFlagSignature                // The payload ends with a signature
+	binaryFlagID                       // The payload has an event ID
+	binaryFlagUUIDID                   // The event ID is a UUID stored as 16 bytes
+	binaryFlagPolicy                   // The payload ends with the max requests and window
+	binaryFlagDuration                 // The payload ends with a duration
+	binaryFlagTraceParent              // The payload ends with a W3C traceparent
+)
+
+// Flags of the second flags byte of a binaryCodecExtendedVersion payload.
+const (
+	binaryExtFlagCount = 1 << iota // The payload ends with the count of requests
+)
+
+// binaryEvents maps the known events to the single byte codes used by the BinaryCodec.
+// Code 0 is followed by the event name for events not in the table.
+var binaryEvents = []string{
+	1:  RequestAccepted,
+	2:  KeyReset,
+	3:  KeyBanned,
+	4:  KeyUnbanned,
+	5:  PolicyUpdated,
+	6:  AllowListAdded,
+	7:  AllowListRemoved,
+	8:  DenyListAdded,
+	9:  DenyListRemoved,
+	10: LimitsUpdated,
+}
+
+// BinaryCodec is a compact binary Codec. Event and broker IDs that are UUIDs, like
+// the ones generated by the RateBroker, are stored as 16 bytes, known events as a
+// single byte and the timestamp as a varint of Unix nanoseconds.
+type BinaryCodec struct {
+	// HashKeys stores the keys of the events scoped to a key, e.g. RequestAccepted or
+	// KeyBanned, as 8 bytes rather than 16 hexadecimal characters. The keys must already
+	// be hashed in that form, by WithKeyHashing or HashKey, and are decoded unchanged,
+	// so that signatures and limits line up on every replica. Encoding such an event
+	// with another key fails with ErrUnhashedKey. Allow and deny list entries are
+	// always stored as is.
+	HashKeys bool
+}
+
+// hashesKey reports whether the key of the event is stored as a hash with HashKeys,
+// returning the hash.
+func (c BinaryCodec) hashesKey(msg Message) (uint64, bool, error) {
+	if !c.HashKeys {
+		return 0, false, nil
+	}
+
+	switch msg.Event {
+	case RequestAccepted, KeyReset, KeyBanned, KeyUnbanned, PolicyUpdated:
+		hash, ok := parseHashKey(msg.Key)
+		if !ok {
+			return 0, false, fmt.Errorf("%w: %s event with key %q", ErrUnhashedKey, msg.Event, msg.Key)
+		}
+		return hash, true, nil
+	default:
+		return 0, false, nil
+	}
+}
+
+// Encode encodes the message into the compact binary format.
+func (c BinaryCodec) Encode(msg Message) ([]byte, error) {
+	var flags byte
+	brokerID, uuidErr := uuid.Parse(msg.BrokerID)
+	if uuidErr == nil && brokerID.String() == msg.BrokerID {
+		flags |= binaryFlagUUIDBrokerID
+	}
+	hash, hashed, err := c.hashesKey(msg)
+	if err != nil {
+		return nil, err
+	}
+	if hashed {
+		flags |= binaryFlagHashedKey
+	}
+	if msg.Signature != "" {
+		flags |= binaryFlagSignature
+	}
+	eventID, uuidErr := uuid.Parse(msg.ID)
+	if msg.ID != "" {
+		flags |= binaryFlagID
+		if uuidErr == nil && eventID.String() == msg.ID {
+			flags |= binaryFlagUUIDID
+		}
+	}
+
+	if msg.MaxRequests != 0 || msg.Window != 0 {
+		flags |= binaryFlagPolicy
+	}
+	if msg.Duration != 0 {
+		flags |= binaryFlagDuration
+	}
+	if msg.TraceParent != "" {
+		flags |= binaryFlagTraceParent
+	}
+	var extFlags byte
+	if msg.Count != 0 {
+		extFlags |= binaryExtFlagCount
+	}
+
+	buf := make([]byte, 0, 32+len(msg.Key)+len(msg.Signature))
+	if extFlags != 0 {
+		buf = append(buf, binaryCodecExtendedVersion, flags, extFlags)
+	} else {
+		buf = append(buf, binaryCodecVersion, flags)
+	}
+
+	if flags&binaryFlagUUIDBrokerID != 0 {
+		buf = append(buf, brokerID[:]...)
+	} else {
+		buf = appendString(buf, msg.BrokerID)
+	}
+
+	if flags&binaryFlagUUIDID != 0 {
+		buf = append(buf, eventID[:]...)
+	} else if flags&binaryFlagID != 0 {
+		buf = appendString(buf, msg.ID)
+	}
+
+	buf = appendEvent(buf, msg.Event)
+
+	var timestamp int64
+	if !msg.Timestamp.IsZero() {
+		timestamp = msg.Timestamp.UnixNano()
+	}
+	buf = binary.AppendVarint(buf, timestamp)
+
+	if hashed {
+		buf = binary.BigEndian.AppendUint64(buf, hash)
+	} else {
+		buf = appendString(buf, msg.Key)
+	}
+
+	if flags&binaryFlagSignature != 0 {
+		buf = appendString(buf, msg.Signature)
+	}
+
+	if flags&binaryFlagPolicy != 0 {
+		buf = binary.AppendVarint(buf, int64(msg.MaxRequests))
+		buf = binary.AppendVarint(buf, int64(msg.Window))
+	}
+	if flags&binaryFlagDuration != 0 {
+		buf = binary.AppendVarint(buf, int64(msg.Duration))
+	}
+	if flags&binaryFlagTraceParent != 0 {
+		buf = appendString(buf, msg.TraceParent)
+	}
+	if extFlags&binaryExtFlagCount != 0 {
+		buf = binary.AppendVarint(buf, int64(msg.Count))
+	}
+
+	return buf, nil
+}
+
+// Decode decodes a message encoded by a BinaryCodec, with or without HashKeys.
+func (c BinaryCodec) Decode(data []byte) (Message, error) {
+	var msg Message
+	d := binaryDecoder{data: data}
+
+	version := d.byte()
+	if version != binaryCodecVersion && version != binaryCodecExtendedVersion {
+		return msg, fmt.Errorf("%w: unsupported version %d", ErrMalformedPayload, version)
+	}
+	flags := d.byte()
+	var extFlags byte
+	if version == binaryCodecExtendedVersion {
+		extFlags = d.byte()
+	}
+
+	if flags&binaryFlagUUIDBrokerID != 0 {
+		id, err := uuid.FromBytes(d.bytes(16))
+		if err == nil {
+			msg.BrokerID = id.String()
+		}
+	} else {
+		msg.BrokerID = d.string()
+	}
+
+	if flags&binaryFlagUUIDID != 0 {
+		id, err := uuid.FromBytes(d.bytes(16))
+		if err == nil {
+			msg.ID = id.String()
+		}
+	} else if flags&binaryFlagID != 0 {
+		msg.ID = d.string()
+	}
+
+	if code := d.uvarint(); code == 0 {
+		msg.Event = d.string()
+	} else if code < uint64(len(binaryEvents)) && binaryEvents[code] != "" {
+		msg.Event = binaryEvents[code]
+	} else {
+		return msg, fmt.Errorf("%w: unknown event code %d", ErrMalformedPayload, code)
+	}
+
+	if timestamp := d.varint(); timestamp != 0 {
+		msg.Timestamp = time.Unix(0, timestamp).UTC()
+	}
+
+	if flags&binaryFlagHashedKey != 0 {
+		msg.Key = hex.EncodeToString(d.bytes(8))
+	} else {
+		msg.Key = d.string()
+	}
+
+	if flags&binaryFlagSignature != 0 {
+		msg.Signature = d.string()
+	}
+
+	if flags&binaryFlagPolicy != 0 {
+		msg.MaxRequests = int(d.varint())
+		msg.Window = time.Duration(d.varint())
+	}
+	if flags&binaryFlagDuration != 0 {
+		msg.Duration = time.Duration(d.varint())
+	}
+	if flags&binaryFlagTraceParent != 0 {
+		msg.TraceParent = d.string()
+	}
+	if extFlags&binaryExtFlagCount != 0 {
+		msg.Count = int(d.varint())
+	}
+
+	if d.err != nil {
+		return Message{}, d.err
+	}
+	if len(d.data) > 0 {
+		return Message{}, fmt.Errorf("%w: %d trailing bytes", ErrMalformedPayload, len(d.data))
+	}
+
+	return msg, nil
+}
+
+// HashKey returns the 64 bit FNV-1a hash of the key as 16 hexadecimal characters,
+// the form in which a BinaryCodec with HashKeys stores keys. Keys that already are in
+// that form are returned as is. Unlike WithKeyHashing the hash is not keyed.
+func HashKey(key string) string {
+	if _, ok := parseHashKey(key); ok {
+		return key
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(key))
+
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], h.Sum64())
+	return hex.EncodeToString(buf[:])
+}
+
+// parseHashKey decodes a key in the form of HashKey.
+func parseHashKey(key string) (uint64, bool) {
+	if len(key) != 16 {
+		return 0, false
+	}
+	decoded, err := hex.DecodeString(key)
+	if err != nil || hex.EncodeToString(decoded) != key {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(decoded), true
+}
+
+func appendString(buf []byte, s string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(s)))
+	return append(buf, s...)
+}
+
+func appendEvent(buf []byte, event string) []byte {
+	for code, known := range binaryEvents {
+		if known != "" && known == event {
+			return binary.AppendUvarint(buf, uint64(code))
+		}
+	}
+
+	buf = binary.AppendUvarint(buf, 0)
+	return appendString(buf, event)
+}
+
+// binaryDecoder reads fields from a payload, recording the first error and returning zero values after it.
+type binaryDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *binaryDecoder) fail(field string) {
+	if d.err == nil {
+		d.err = fmt.Errorf("%w: truncated %s", ErrMalformedPayload, field)
+	}
+	d.data = nil
+}
+
+func (d *binaryDecoder) byte() byte {
+	if len(d.data) < 1 {
+		d.fail("header")
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *binaryDecoder) bytes(n int) []byte {
+	if len(d.data) < n {
+		d.fail("field")
+		return make([]byte, n)
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail("varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) varint() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail("varint")
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *binaryDecoder) string() string {
+	n := d.uvarint()
+	if n > uint64(len(d.data)) {
+		d.fail("string")
+		return ""
+	}
+	return string(d.bytes(int(n)))
+}
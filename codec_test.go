@@ -0,0 +1,200 @@
+//go:build unit
+
+package ratebroker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func testMessage() Message {
+	return Message{
+		ID:        uuid.NewString(),
+		BrokerID:  uuid.NewString(),
+		Event:     RequestAccepted,
+		Timestamp: time.Now(),
+		Key:       "203.0.113.195:51234",
+	}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	codecs := map[string]Codec{
+		"json":   JSONCodec{},
+		"binary": BinaryCodec{},
+	}
+
+	messages := map[string]Message{
+		"uuid broker ID":    testMessage(),
+		"custom broker ID":  {BrokerID: "pod-1", Event: RequestAccepted, Timestamp: time.Now(), Key: "user1"},
+		"unknown event":     {BrokerID: "pod-1", Event: "CUSTOM_EVENT", Timestamp: time.Now(), Key: "user1"},
+		"zero timestamp":    {BrokerID: "pod-1", Event: RequestAccepted, Key: "user1"},
+		"custom event ID":   {ID: "event-1", BrokerID: "pod-1", Event: RequestAccepted, Timestamp: time.Now(), Key: "user1"},
+		"signed":            {BrokerID: "pod-1", Event: RequestAccepted, Timestamp: time.Now(), Key: "user1", Signature: "key-1:c2lnbmF0dXJl"},
+		"uppercase uuid ID": {BrokerID: "6BA7B810-9DAD-11D1-80B4-00C04FD430C8", Event: RequestAccepted, Timestamp: time.Now(), Key: "user1"},
+		"ban":               {BrokerID: "pod-1", Event: KeyBanned, Timestamp: time.Now(), Key: "user1", Duration: time.Hour},
+		"policy update":     {BrokerID: "pod-1", Event: PolicyUpdated, Timestamp: time.Now(), Key: "user1", MaxRequests: 100, Window: time.Minute},
+		"traced":            {BrokerID: "pod-1", Event: RequestAccepted, Timestamp: time.Now(), Key: "user1", TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		"count":             {BrokerID: "pod-1", Event: RequestAccepted, Timestamp: time.Now(), Key: "user1", Count: 500},
+	}
+
+	for codecName, codec := range codecs {
+		for msgName, original := range messages {
+			t.Run(codecName+"/"+msgName, func(t *testing.T) {
+				data, err := codec.Encode(original)
+				if err != nil {
+					t.Fatalf("Unexpected error encoding: %v", err)
+				}
+
+				decoded, err := codec.Decode(data)
+				if err != nil {
+					t.Fatalf("Unexpected error decoding: %v", err)
+				}
+
+				if !decoded.Timestamp.Equal(original.Timestamp) {
+					t.Errorf("Timestamp not preserved. Want: %v, got: %v", original.Timestamp, decoded.Timestamp)
+				}
+				decoded.Timestamp, original.Timestamp = time.Time{}, time.Time{}
+				if decoded != original {
+					t.Errorf("Message not preserved. Want: %+v, got: %+v", original, decoded)
+				}
+			})
+		}
+	}
+}
+
+func TestBinaryCodec_Count(t *testing.T) {
+	codec := BinaryCodec{}
+
+	// Payloads without a count keep the first version, older replicas can decode them
+	data, err := codec.Encode(testMessage())
+	if err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	if data[0] != binaryCodecVersion {
+		t.Errorf("Expected version %d without a count, got %d", binaryCodecVersion, data[0])
+	}
+
+	msg := testMessage()
+	msg.Count = 3
+	if data, err = codec.Encode(msg); err != nil {
+		t.Fatalf("Unexpected error encoding: %v", err)
+	}
+	if data[0] != binaryCodecExtendedVersion {
+		t.Errorf("Expected version %d with a count, got %d", binaryCodecExtendedVersion, data[0])
+	}
+	if decoded, err := codec.Decode(data); err != nil || decoded.Count != 3 {
+		t.Errorf("Expected the count to be decoded, got %+v, %v", decoded, err)
+	}
+}
+
+func TestBinaryCodec_HashKeys(t *testing.T) {
+	codec := BinaryCodec{HashKeys: true}
+
+	messages := map[string]Message{
+		"hashed key":         {BrokerID: "pod-1", Event: RequestAccepted, Timestamp: time.Now(), Key: HashKey("user1")},
+		"hashed ban":         {BrokerID: "pod-1", Event: KeyBanned, Timestamp: time.Now(), Key: HashKey("user1"), Duration: time.Hour},
+		"allow list entry":   {BrokerID: "pod-1", Event: AllowListAdded, Timestamp: time.Now(), Key: "10.0.0.0/8"},
+		"deny list entry":    {BrokerID: "pod-1", Event: DenyListAdded, Timestamp: time.Now(), Key: "user1"},
+		"limits without key": {BrokerID: "pod-1", Event: LimitsUpdated, Timestamp: time.Now(), MaxRequests: 10, Window: time.Minute},
+	}
+
+	for name, original := range messages {
+		t.Run(name, func(t *testing.T) {
+			data, err := codec.Encode(original)
+			if err != nil {
+				t.Fatalf("Unexpected error encoding: %v", err)
+			}
+			decoded, err := codec.Decode(data)
+			if err != nil {
+				t.Fatalf("Unexpected error decoding: %v", err)
+			}
+
+			decoded.Timestamp, original.Timestamp = time.Time{}, time.Time{}
+			if decoded != original {
+				t.Errorf("Message not preserved. Want: %+v, got: %+v", original, decoded)
+			}
+		})
+	}
+
+	// Hashed keys take 8 bytes instead of 16 characters
+	hashed, _ := codec.Encode(messages["hashed key"])
+	plain, _ := BinaryCodec{}.Encode(messages["hashed key"])
+	if len(plain)-len(hashed) != 9 {
+		t.Errorf("Expected the hashed key to be stored in 8 bytes, got %d and %d bytes", len(hashed), len(plain))
+	}
+
+	if _, err := codec.Encode(testMessage()); !errors.Is(err, ErrUnhashedKey) {
+		t.Errorf("Expected ErrUnhashedKey for a key that is not hashed, got %v", err)
+	}
+}
+
+func TestBinaryCodec_Malformed(t *testing.T) {
+	codec := BinaryCodec{}
+	data, _ := codec.Encode(testMessage())
+
+	testCases := map[string][]byte{
+		"empty":           {},
+		"unknown version": append([]byte{99}, data[1:]...),
+		"truncated":       data[:len(data)-3],
+		"trailing bytes":  append(append([]byte{}, data...), 0),
+		"unknown event":   {binaryCodecVersion, 0, 0, 42},
+	}
+
+	for name, payload := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := codec.Decode(payload); !errors.Is(err, ErrMalformedPayload) {
+				t.Errorf("Expected ErrMalformedPayload, got %v", err)
+			}
+		})
+	}
+}
+
+// BenchmarkCodec compares the size and speed of the message encodings,
+// the size is reported as bytes/msg.
+func BenchmarkCodec(b *testing.B) {
+	msg := testMessage()
+	msg.Key = HashKey(msg.Key)
+
+	b.Run("Fields", func(b *testing.B) {
+		size := 0
+		for field, value := range encodeMessage(msg) {
+			size += len(field) + len(value.(string))
+		}
+		b.ReportMetric(float64(size), "bytes/msg")
+
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeMessage(encodeMessage(msg)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	codecs := []struct {
+		name  string
+		codec Codec
+	}{
+		{"JSON", JSONCodec{}},
+		{"Binary", BinaryCodec{}},
+		{"BinaryHashedKeys", BinaryCodec{HashKeys: true}},
+	}
+
+	for _, c := range codecs {
+		b.Run(c.name, func(b *testing.B) {
+			data, _ := c.codec.Encode(msg)
+			b.ReportMetric(float64(len(fieldPayload)+len(data)), "bytes/msg")
+
+			for i := 0; i < b.N; i++ {
+				data, err := c.codec.Encode(msg)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := c.codec.Decode(data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
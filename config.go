@@ -0,0 +1,367 @@
+package ratebroker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/parkerroan/ratebroker/limiter"
+	"golang.org/x/exp/slog"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidConfig is returned when a configuration file cannot be parsed or has invalid values.
+var ErrInvalidConfig = errors.New("invalid config")
+
+// Config is the configuration of a RateBroker loaded from a YAML or JSON file, see
+// LoadConfig and WatchConfigFile. The limits replace the default limits, like UpdateLimits
+// does but only on this replica, and are left unchanged when unset. For example:
+//
+//	max_requests: 30
+//	window: 10s
+//	limiter: ring
+//	policies:
+//	  - key: premium-*
+//	    max_requests: 300
+//	    window: 10s
+//	allow: [svc-*, 10.0.0.0/8]
+//	deny: [203.0.113.195]
+//	broker:
+//	  stream: ratebroker
+//	  codec: binary
+type Config struct {
+	MaxRequests int      `json:"max_requests,omitempty" yaml:"max_requests,omitempty"`
+	Window      Duration `json:"window,omitempty" yaml:"window,omitempty"`
+	// Limiter is the limiter type, "ring" or "heap", the one set by WithLimiterContructorFunc if empty
+	Limiter string `json:"limiter,omitempty" yaml:"limiter,omitempty"`
+	// Policies override the limit of the keys they match, the most specific one wins
+	Policies []PolicyConfig `json:"policies,omitempty" yaml:"policies,omitempty"`
+	// Allow and Deny hold allow and deny list entries, see RateBroker.AddToAllowList
+	Allow  []string     `json:"allow,omitempty" yaml:"allow,omitempty"`
+	Deny   []string     `json:"deny,omitempty" yaml:"deny,omitempty"`
+	Broker BrokerConfig `json:"broker,omitempty" yaml:"broker,omitempty"`
+}
+
+// PolicyConfig is the limit of the keys matching Key: a prefix when it ends in "*",
+// otherwise an exact key. Exact keys are hashed when WithKeyHashing is used, prefixes
+// only match keys when it is not.
+type PolicyConfig struct {
+	Key         string   `json:"key" yaml:"key"`
+	MaxRequests int      `json:"max_requests" yaml:"max_requests"`
+	Window      Duration `json:"window" yaml:"window"`
+}
+
+// BrokerConfig holds the options of a RedisMessageBroker, see Options.
+// Unlike the rest of the Config they are only applied when the broker is created.
+type BrokerConfig struct {
+	Stream         string   `json:"stream,omitempty" yaml:"stream,omitempty"`
+	Shards         int      `json:"shards,omitempty" yaml:"shards,omitempty"`
+	Codec          string   `json:"codec,omitempty" yaml:"codec,omitempty"` // "fields" (default), "json" or "binary"
+	InitLoadOffset Duration `json:"init_load_offset,omitempty" yaml:"init_load_offset,omitempty"`
+	ConsumerGroup  string   `json:"consumer_group,omitempty" yaml:"consumer_group,omitempty"` // The consumer ID
+}
+
+// Duration is a time.Duration written as a string such as "1m30s" in configuration files.
+type Duration time.Duration
+
+// MarshalJSON encodes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON decodes a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %w", err)
+	}
+	return d.parse(s)
+}
+
+// MarshalYAML encodes the duration as a string.
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return time.Duration(d).String(), nil
+}
+
+// UnmarshalYAML decodes a duration string.
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.parse(value.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// LoadConfig reads the configuration file at path, as JSON when its extension is
+// .json and as YAML when it is .yaml or .yml. Unknown fields are rejected.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseConfig(path, data)
+}
+
+// parseConfig parses the contents of the config file at path.
+func parseConfig(path string, data []byte) (*Config, error) {
+	var cfg Config
+	var err error
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err = decoder.Decode(&cfg)
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err = decoder.Decode(&cfg); errors.Is(err, io.EOF) {
+			err = nil // An empty file is an empty config
+		}
+	default:
+		return nil, fmt.Errorf("%w: unsupported file extension %q", ErrInvalidConfig, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrInvalidConfig, path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// Validate checks the limits, policies, list entries and broker options of the config.
+func (c *Config) Validate() error {
+	if c.MaxRequests < 0 || c.Window < 0 {
+		return fmt.Errorf("%w: max_requests and window cannot be negative", ErrInvalidConfig)
+	}
+
+	if _, ok := configLimiters[c.Limiter]; c.Limiter != "" && !ok {
+		return fmt.Errorf("%w: unknown limiter %q", ErrInvalidConfig, c.Limiter)
+	}
+
+	for _, policy := range c.Policies {
+		if policy.Key == "" {
+			return fmt.Errorf("%w: policy without a key", ErrInvalidConfig)
+		}
+		if policy.MaxRequests <= 0 || policy.Window <= 0 {
+			return fmt.Errorf("%w: policy %q needs a positive max_requests and window", ErrInvalidConfig, policy.Key)
+		}
+	}
+
+	for _, entry := range append(append([]string{}, c.Allow...), c.Deny...) {
+		if _, err := parseAccessEntry(entry); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+
+	if _, err := c.Broker.Options(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Options returns the RedisMessageBroker options for the config.
+func (c BrokerConfig) Options() ([]func(*RedisMessageBroker), error) {
+	var opts []func(*RedisMessageBroker)
+
+	if c.Stream != "" {
+		opts = append(opts, WithStream(c.Stream))
+	}
+	if c.Shards < 0 {
+		return nil, fmt.Errorf("%w: broker shards cannot be negative", ErrInvalidConfig)
+	}
+	if c.Shards > 0 {
+		opts = append(opts, WithShards(c.Shards))
+	}
+	if c.InitLoadOffset > 0 {
+		opts = append(opts, WithInitLoadOffset(time.Duration(c.InitLoadOffset)))
+	}
+	if c.ConsumerGroup != "" {
+		opts = append(opts, WithConsumerGroup(c.ConsumerGroup))
+	}
+
+	switch c.Codec {
+	case "", "fields":
+	case "json":
+		opts = append(opts, WithCodec(JSONCodec{}))
+	case "binary":
+		opts = append(opts, WithCodec(BinaryCodec{}))
+	default:
+		return nil, fmt.Errorf("%w: unknown broker codec %q", ErrInvalidConfig, c.Codec)
+	}
+
+	return opts, nil
+}
+
+// configLimiters are the limiter types a Config can select.
+var configLimiters = map[string]NewLimiterFunc{
+	"ring": limiter.NewRingLimiterConstructorFunc(),
+	"heap": limiter.NewHeapLimiterConstructorFunc(),
+}
+
+// configState is the applied Config, matched by policyFor and checkAccessLists.
+type configState struct {
+	source         *Config
+	limiter        string
+	policies       map[string]LimitDetails // By stored key
+	prefixPolicies []prefixPolicy          // Longest prefix first
+	allowList      *accessList
+	denyList       *accessList
+}
+
+type prefixPolicy struct {
+	prefix string
+	limit  LimitDetails
+}
+
+// ApplyConfig replaces the policies, allow and deny lists and limiter type set by the
+// previous config with the ones in cfg, and the default limits with the ones it sets.
+// It only applies to this replica, every replica is expected to load the same file.
+// The broker options are ignored, see BrokerConfig.
+//
+// Policies set by UpdatePolicy take precedence over the config's, and list entries added
+// through the RateBroker's methods are kept alongside its lists. Existing keys switch to
+// their new limit on their next request, keeping the requests tracked for them, see
+// UpdateLimits. Keys whose limiter type changed start from scratch.
+func (rb *RateBroker) ApplyConfig(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	state := &configState{
+		source:    cfg,
+		limiter:   cfg.Limiter,
+		policies:  make(map[string]LimitDetails),
+		allowList: newAccessList(),
+		denyList:  newAccessList(),
+	}
+
+	for _, policy := range cfg.Policies {
+		limit := LimitDetails{MaxRequests: policy.MaxRequests, Window: time.Duration(policy.Window)}
+		if prefix, ok := strings.CutSuffix(policy.Key, "*"); ok {
+			state.prefixPolicies = append(state.prefixPolicies, prefixPolicy{prefix, limit})
+		} else {
+			state.policies[rb.StoredKey(policy.Key)] = limit
+		}
+	}
+	sort.SliceStable(state.prefixPolicies, func(i, j int) bool {
+		return len(state.prefixPolicies[i].prefix) > len(state.prefixPolicies[j].prefix)
+	})
+
+	for _, entry := range cfg.Allow {
+		parsed, _ := parseAccessEntry(rb.storedEntry(entry))
+		state.allowList.add(parsed)
+	}
+	for _, entry := range cfg.Deny {
+		parsed, _ := parseAccessEntry(rb.storedEntry(entry))
+		state.denyList.add(parsed)
+	}
+
+	rb.controlMutex.Lock()
+	rb.config = state
+	if cfg.MaxRequests > 0 {
+		rb.maxRequests = cfg.MaxRequests
+	}
+	if cfg.Window > 0 {
+		rb.window = time.Duration(cfg.Window)
+	}
+	rb.controlMutex.Unlock()
+
+	return nil
+}
+
+// limiterFor returns the limiter type to create, from the config if it sets one, with its constructor.
+func (rb *RateBroker) limiterFor() (string, NewLimiterFunc) {
+	rb.controlMutex.RLock()
+	defer rb.controlMutex.RUnlock()
+
+	if rb.config != nil && rb.config.limiter != "" {
+		return rb.config.limiter, configLimiters[rb.config.limiter]
+	}
+	return "", rb.newLimiterFunc
+}
+
+// Config returns the config last applied by ApplyConfig, nil if none was.
+func (rb *RateBroker) Config() *Config {
+	rb.controlMutex.RLock()
+	defer rb.controlMutex.RUnlock()
+
+	if rb.config == nil {
+		return nil
+	}
+	return rb.config.source
+}
+
+// WatchConfigFile loads the config file at path, see LoadConfig, and applies it with
+// ApplyConfig. It then checks the file for changes every interval until the context is
+// done and applies them. Invalid changes are logged and the previous config is kept.
+// Changes to the broker options are logged as they require a restart.
+func (rb *RateBroker) WatchConfigFile(ctx context.Context, path string, interval time.Duration) error {
+	last, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := parseConfig(path, last)
+	if err != nil {
+		return err
+	}
+	if err := rb.ApplyConfig(cfg); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				rb.logger.Error("error reading config file", slog.String("path", path), slog.Any("error", err.Error()))
+				continue
+			}
+			if bytes.Equal(data, last) {
+				continue
+			}
+			last = data
+
+			updated, err := parseConfig(path, data)
+			if err != nil {
+				rb.logger.Error("invalid config file, keeping the previous config", slog.String("path", path), slog.Any("error", err.Error()))
+				continue
+			}
+
+			if previous := rb.Config(); previous != nil && previous.Broker != updated.Broker {
+				rb.logger.Warn("broker config changed, restart to apply it", slog.String("path", path))
+			}
+
+			if err := rb.ApplyConfig(updated); err != nil {
+				rb.logger.Error("error applying config", slog.String("path", path), slog.Any("error", err.Error()))
+				continue
+			}
+			rb.logger.Info("config reloaded", slog.String("path", path))
+		}
+	}()
+
+	return nil
+}
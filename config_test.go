@@ -0,0 +1,184 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+const testYAMLConfig = `
+max_requests: 2
+window: 1m
+limiter: heap
+policies:
+  - key: premium-*
+    max_requests: 5
+    window: 1m
+  - key: premium-gold-*
+    max_requests: 10
+    window: 30s
+  - key: vip
+    max_requests: 20
+    window: 1m
+allow: [svc-*]
+deny: [203.0.113.0/24]
+broker:
+  stream: limits
+  shards: 2
+  codec: binary
+`
+
+const testJSONConfig = `{
+  "max_requests": 2,
+  "window": "1m",
+  "policies": [{"key": "premium-*", "max_requests": 5, "window": "1m"}],
+  "deny": ["203.0.113.0/24"]
+}`
+
+func writeConfig(t *testing.T, name, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatalf("Unexpected error writing config: %v", err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	for name, contents := range map[string]string{"config.yaml": testYAMLConfig, "config.json": testJSONConfig} {
+		t.Run(name, func(t *testing.T) {
+			cfg, err := ratebroker.LoadConfig(writeConfig(t, name, contents))
+			if err != nil {
+				t.Fatalf("Unexpected error loading config: %v", err)
+			}
+
+			if cfg.MaxRequests != 2 || time.Duration(cfg.Window) != time.Minute {
+				t.Errorf("Defaults not loaded, got %d per %v", cfg.MaxRequests, time.Duration(cfg.Window))
+			}
+			if len(cfg.Policies) == 0 || cfg.Policies[0].Key != "premium-*" || cfg.Policies[0].MaxRequests != 5 {
+				t.Errorf("Policies not loaded, got %+v", cfg.Policies)
+			}
+			if len(cfg.Deny) != 1 {
+				t.Errorf("Deny list not loaded, got %v", cfg.Deny)
+			}
+		})
+	}
+
+	cfg, err := ratebroker.LoadConfig(writeConfig(t, "config.yml", testYAMLConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %v", err)
+	}
+	opts, err := cfg.Broker.Options()
+	if err != nil || len(opts) != 3 {
+		t.Errorf("Expected 3 broker options, got %d, %v", len(opts), err)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	testCases := map[string]string{
+		"config.yaml": "max_requests: many",
+		"other.yaml":  "unknown_field: 1",
+		"config.json": `{"window": 60}`,
+		"policy.yaml": "policies: [{key: user1, max_requests: 0, window: 1m}]",
+		"entry.yaml":  "allow: ['']",
+		"codec.yaml":  "broker: {codec: xml}",
+		"type.yaml":   "limiter: bucket",
+		"config.toml": "max_requests = 1",
+	}
+
+	for name, contents := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if _, err := ratebroker.LoadConfig(writeConfig(t, name, contents)); !errors.Is(err, ratebroker.ErrInvalidConfig) {
+				t.Errorf("Expected ErrInvalidConfig, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRateBroker_ApplyConfig(t *testing.T) {
+	ctx := context.Background()
+
+	cfg, err := ratebroker.LoadConfig(writeConfig(t, "config.yaml", testYAMLConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error loading config: %v", err)
+	}
+
+	rb := ratebroker.NewRateBroker(ratebroker.WithMaxRequests(100))
+	if err := rb.ApplyConfig(cfg); err != nil {
+		t.Fatalf("Unexpected error applying config: %v", err)
+	}
+
+	testCases := map[string]ratebroker.LimitDetails{
+		"user1":            {MaxRequests: 2, Window: time.Minute},
+		"premium-silver-1": {MaxRequests: 5, Window: time.Minute},
+		"premium-gold-1":   {MaxRequests: 10, Window: 30 * time.Second},
+		"vip":              {MaxRequests: 20, Window: time.Minute},
+	}
+	for key, expected := range testCases {
+		if _, details := rb.TryAccept(ctx, key); details != expected {
+			t.Errorf("%s: expected %+v, got %+v", key, expected, details)
+		}
+	}
+
+	if allowed, _ := rb.TryAccept(ctx, "203.0.113.7"); allowed {
+		t.Error("Key on the config's deny list should be rejected")
+	}
+	for i := 0; i < 5; i++ {
+		if allowed, _ := rb.TryAccept(ctx, "svc-billing"); !allowed {
+			t.Error("Key on the config's allow list should be allowed")
+		}
+	}
+
+	if err := rb.UpdatePolicy(ctx, "vip", 50, time.Minute); err != nil {
+		t.Fatalf("Unexpected error updating policy: %v", err)
+	}
+	if _, details := rb.TryAccept(ctx, "vip"); details.MaxRequests != 50 {
+		t.Errorf("UpdatePolicy should take precedence over the config, got %+v", details)
+	}
+}
+
+func TestRateBroker_WatchConfigFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := writeConfig(t, "config.yaml", "max_requests: 1\nwindow: 1m\n")
+
+	rb := ratebroker.NewRateBroker()
+	if err := rb.WatchConfigFile(ctx, path, 10*time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error watching config: %v", err)
+	}
+
+	rb.TryAccept(ctx, "user1")
+	if allowed, _ := rb.TryAccept(ctx, "user1"); allowed {
+		t.Fatal("Request over the configured limit should be rejected")
+	}
+
+	// Invalid changes keep the previous config
+	if err := os.WriteFile(path, []byte("max_requests: -1\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error writing config: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, details := rb.TryAccept(ctx, "user1"); details.MaxRequests != 1 {
+		t.Fatalf("Invalid config should not be applied, got %+v", details)
+	}
+
+	if err := os.WriteFile(path, []byte("max_requests: 3\nwindow: 1m\nlimiter: heap\ndeny: [user2]\n"), 0o600); err != nil {
+		t.Fatalf("Unexpected error writing config: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	allowed, details := rb.TryAccept(ctx, "user1")
+	if !allowed || details.MaxRequests != 3 {
+		t.Errorf("Updated limit should be applied, got %v %+v", allowed, details)
+	}
+	if allowed, _ := rb.TryAccept(ctx, "user2"); allowed {
+		t.Error("Updated deny list should be applied")
+	}
+}
@@ -0,0 +1,219 @@
+package ratebroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ErrInvalidControl is returned when a control event has invalid arguments,
+// e.g. a ban without a duration or a policy without a limit.
+var ErrInvalidControl = errors.New("invalid control event")
+
+// ResetKey clears the requests tracked for the key on every replica.
+func (rb *RateBroker) ResetKey(ctx context.Context, key string) error {
+	return rb.publishControl(ctx, Message{Event: KeyReset, Key: rb.StoredKey(key)})
+}
+
+// BanKey rejects every request for the key on every replica for the duration.
+// Banning a key that is already banned replaces its ban.
+func (rb *RateBroker) BanKey(ctx context.Context, key string, duration time.Duration) error {
+	return rb.publishControl(ctx, Message{Event: KeyBanned, Key: rb.StoredKey(key), Duration: duration})
+}
+
+// UnbanKey lifts the ban on the key on every replica.
+func (rb *RateBroker) UnbanKey(ctx context.Context, key string) error {
+	return rb.publishControl(ctx, Message{Event: KeyUnbanned, Key: rb.StoredKey(key)})
+}
+
+// UpdatePolicy changes the limit of the key to maxRequests per window on every replica,
+// overriding the default limit. The requests already tracked for the key are kept
+// when its limiter implements limiter.Resizer, like the ones in the limiter package.
+func (rb *RateBroker) UpdatePolicy(ctx context.Context, key string, maxRequests int, window time.Duration) error {
+	return rb.publishControl(ctx, Message{Event: PolicyUpdated, Key: rb.StoredKey(key), MaxRequests: maxRequests, Window: window})
+}
+
+// UpdateLimits changes the default limit to maxRequests per window on every replica.
+// It applies to every key without a policy of its own, keys already tracked switch to it
+// on their next request or Usage, keeping the requests recorded for them, see limiter.Resizer.
+func (rb *RateBroker) UpdateLimits(ctx context.Context, maxRequests int, window time.Duration) error {
+	return rb.publishControl(ctx, Message{Event: LimitsUpdated, MaxRequests: maxRequests, Window: window})
+}
+
+// publishControl applies the control event locally and publishes it so the other replicas apply it too.
+// Unlike accepted requests it is published synchronously so that the caller learns about failures.
+func (rb *RateBroker) publishControl(ctx context.Context, msg Message) error {
+	msg.ID = uuid.NewString()
+	msg.BrokerID = rb.id
+	msg.Timestamp = rb.Now()
+
+	if err := rb.applyControl(msg); err != nil {
+		return err
+	}
+
+	if rb.broker == nil {
+		return nil
+	}
+
+	if err := rb.publish(ctx, msg); err != nil {
+		return fmt.Errorf("error publishing %s event: %w", msg.Event, err)
+	}
+	return nil
+}
+
+// applyControl applies a control event published by any replica.
+func (rb *RateBroker) applyControl(msg Message) error {
+	switch msg.Event {
+	case KeyReset:
+		rb.deleteEntry(msg.Key)
+
+		rb.controlMutex.Lock()
+		if last, ok := rb.resets[msg.Key]; !ok || msg.Timestamp.After(last) {
+			rb.resets[msg.Key] = msg.Timestamp
+		}
+		rb.sweepControl(rb.Now())
+		rb.controlMutex.Unlock()
+
+	case KeyBanned:
+		if msg.Duration <= 0 {
+			return fmt.Errorf("%w: ban duration must be positive, got %s", ErrInvalidControl, msg.Duration)
+		}
+
+		rb.controlMutex.Lock()
+		rb.bans[msg.Key] = msg.Timestamp.Add(msg.Duration)
+		rb.sweepControl(rb.Now())
+		rb.controlMutex.Unlock()
+
+	case KeyUnbanned:
+		rb.controlMutex.Lock()
+		delete(rb.bans, msg.Key)
+		rb.controlMutex.Unlock()
+
+	case PolicyUpdated:
+		if msg.MaxRequests <= 0 || msg.Window <= 0 {
+			return fmt.Errorf("%w: policy needs a positive limit and window, got %d per %s", ErrInvalidControl, msg.MaxRequests, msg.Window)
+		}
+
+		rb.controlMutex.Lock()
+		rb.policies[msg.Key] = LimitDetails{MaxRequests: msg.MaxRequests, Window: msg.Window}
+		rb.controlMutex.Unlock()
+
+	case LimitsUpdated:
+		if msg.MaxRequests <= 0 || msg.Window <= 0 {
+			return fmt.Errorf("%w: limits need a positive limit and window, got %d per %s", ErrInvalidControl, msg.MaxRequests, msg.Window)
+		}
+
+		rb.controlMutex.Lock()
+		rb.maxRequests, rb.window = msg.MaxRequests, msg.Window
+		rb.controlMutex.Unlock()
+
+	case AllowListAdded, AllowListRemoved, DenyListAdded, DenyListRemoved:
+		return rb.applyAccessList(msg)
+
+	default:
+		return fmt.Errorf("%w: unknown event %q", ErrInvalidControl, msg.Event)
+	}
+
+	return nil
+}
+
+// bannedUntil reports whether the key is banned at now and until when, forgetting bans that expired.
+func (rb *RateBroker) bannedUntil(key string, now time.Time) (time.Time, bool) {
+	rb.controlMutex.RLock()
+	until, ok := rb.bans[key]
+	rb.controlMutex.RUnlock()
+	if !ok {
+		return time.Time{}, false
+	}
+
+	if now.Before(until) {
+		return until, true
+	}
+
+	rb.controlMutex.Lock()
+	if current, ok := rb.bans[key]; ok && current.Equal(until) {
+		delete(rb.bans, key)
+	}
+	rb.controlMutex.Unlock()
+	return time.Time{}, false
+}
+
+// resetBefore reports whether the key was reset after the timestamp.
+func (rb *RateBroker) resetBefore(key string, timestamp time.Time) bool {
+	rb.controlMutex.RLock()
+	defer rb.controlMutex.RUnlock()
+
+	resetAt, ok := rb.resets[key]
+	return ok && timestamp.Before(resetAt)
+}
+
+// controlSweepInterval is how often sweepControl runs at most.
+const controlSweepInterval = time.Minute
+
+// sweepControl forgets the bans that expired, which are otherwise only forgotten when
+// their key is checked again, e.g. the bans of rotating IP addresses, and the resets
+// older than the window of their key, the messages they would drop are too old to be
+// applied anyway. It runs at most once per controlSweepInterval and must be called with
+// the controlMutex held.
+func (rb *RateBroker) sweepControl(now time.Time) {
+	if now.Sub(rb.lastSweep) < controlSweepInterval {
+		return
+	}
+	rb.lastSweep = now
+
+	for key, until := range rb.bans {
+		if !now.Before(until) {
+			delete(rb.bans, key)
+		}
+	}
+
+	for key, resetAt := range rb.resets {
+		if resetAt.Before(now.Add(-rb.policyForLocked(key).Window)) {
+			delete(rb.resets, key)
+		}
+	}
+}
+
+// policyFor returns the limit of the key: the one set by UpdatePolicy if any, otherwise
+// the most specific one from the config, see ApplyConfig, falling back to the defaults
+// set by WithMaxRequests and WithWindow, UpdateLimits or the config.
+func (rb *RateBroker) policyFor(key string) LimitDetails {
+	rb.controlMutex.RLock()
+	defer rb.controlMutex.RUnlock()
+
+	return rb.policyForLocked(key)
+}
+
+// policyForLocked is policyFor with the controlMutex held.
+func (rb *RateBroker) policyForLocked(key string) LimitDetails {
+	if policy, ok := rb.policies[key]; ok {
+		return policy
+	}
+
+	if rb.config != nil {
+		if policy, ok := rb.config.policies[key]; ok {
+			return policy
+		}
+		for _, policy := range rb.config.prefixPolicies {
+			if strings.HasPrefix(key, policy.prefix) {
+				return policy.limit
+			}
+		}
+	}
+
+	return LimitDetails{MaxRequests: rb.maxRequests, Window: rb.window}
+}
+
+// deleteEntry removes the key's entry so that the next request or message starts from scratch.
+func (rb *RateBroker) deleteEntry(key string) {
+	mutex := rb.entryMutex(key)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	rb.cache.Del(key)
+	rb.cache.Wait()
+}
@@ -0,0 +1,205 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+// newControlReplicas starts two replicas sharing a memoryBroker with a limit of maxRequests per minute.
+func newControlReplicas(t *testing.T, ctx context.Context, maxRequests int) (*memoryBroker, *ratebroker.RateBroker, *ratebroker.RateBroker) {
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	newReplica := func() *ratebroker.RateBroker {
+		rb := ratebroker.NewRateBroker(
+			ratebroker.WithBroker(broker),
+			ratebroker.WithMaxRequests(maxRequests),
+			ratebroker.WithWindow(time.Minute),
+		)
+		rb.Start(ctx)
+		return rb
+	}
+
+	replica1, replica2 := newReplica(), newReplica()
+	waitForConsumers(t, broker, 2)
+	return broker, replica1, replica2
+}
+
+func TestRateBroker_ResetKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, replica1, replica2 := newControlReplicas(t, ctx, 2)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := replica1.TryAccept(ctx, "user1"); !allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if allowed, _ := replica2.TryAccept(ctx, "user1"); allowed {
+		t.Fatal("Request over the limit should be rejected")
+	}
+
+	if err := replica2.ResetKey(ctx, "user1"); err != nil {
+		t.Fatalf("Unexpected error resetting key: %v", err)
+	}
+
+	for _, replica := range []*ratebroker.RateBroker{replica1, replica2} {
+		if allowed, _ := replica.TryAccept(ctx, "user1"); !allowed {
+			t.Error("Request after a reset should be allowed on every replica")
+		}
+	}
+}
+
+func TestRateBroker_BanKey(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, replica1, replica2 := newControlReplicas(t, ctx, 10)
+
+	if err := replica1.BanKey(ctx, "user1", time.Hour); err != nil {
+		t.Fatalf("Unexpected error banning key: %v", err)
+	}
+
+	for _, replica := range []*ratebroker.RateBroker{replica1, replica2} {
+		if allowed, _ := replica.TryAccept(ctx, "user1"); allowed {
+			t.Error("Banned key should be rejected on every replica")
+		}
+		if allowed, _ := replica.TryAccept(ctx, "user2"); !allowed {
+			t.Error("Other keys should not be affected by the ban")
+		}
+	}
+
+	if err := replica2.UnbanKey(ctx, "user1"); err != nil {
+		t.Fatalf("Unexpected error unbanning key: %v", err)
+	}
+
+	for _, replica := range []*ratebroker.RateBroker{replica1, replica2} {
+		if allowed, _ := replica.TryAccept(ctx, "user1"); !allowed {
+			t.Error("Unbanned key should be allowed on every replica")
+		}
+	}
+}
+
+func TestRateBroker_BanKeyExpires(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, replica1, replica2 := newControlReplicas(t, ctx, 10)
+
+	if err := replica1.BanKey(ctx, "user1", 50*time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error banning key: %v", err)
+	}
+	if allowed, _ := replica2.TryAccept(ctx, "user1"); allowed {
+		t.Fatal("Banned key should be rejected")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+
+	if allowed, _ := replica2.TryAccept(ctx, "user1"); !allowed {
+		t.Error("Key should be allowed once the ban expired")
+	}
+}
+
+func TestRateBroker_UpdatePolicy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, replica1, replica2 := newControlReplicas(t, ctx, 1)
+
+	if err := replica1.UpdatePolicy(ctx, "user1", 3, 30*time.Second); err != nil {
+		t.Fatalf("Unexpected error updating policy: %v", err)
+	}
+
+	allowed, details := replica2.TryAccept(ctx, "user1")
+	if !allowed {
+		t.Fatal("Request should be allowed")
+	}
+	if details.MaxRequests != 3 || details.Window != 30*time.Second {
+		t.Errorf("Expected the updated policy, got %+v", details)
+	}
+
+	if _, details := replica2.TryAccept(ctx, "user2"); details.MaxRequests != 1 {
+		t.Errorf("Other keys should keep the default policy, got %+v", details)
+	}
+
+	var policyEvents int
+	for _, msg := range broker.published() {
+		if msg.Event == ratebroker.PolicyUpdated {
+			policyEvents++
+			if msg.MaxRequests != 3 || msg.Window != 30*time.Second {
+				t.Errorf("Policy not broadcast, got %+v", msg)
+			}
+		}
+	}
+	if policyEvents != 1 {
+		t.Errorf("Expected 1 policy event, got %d", policyEvents)
+	}
+}
+
+func TestRateBroker_UpdateLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	_, replica1, replica2 := newControlReplicas(t, ctx, 2)
+
+	if err := replica1.UpdatePolicy(ctx, "vip", 10, time.Minute); err != nil {
+		t.Fatalf("Unexpected error updating policy: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if allowed, _ := replica1.TryAccept(ctx, "user1"); !allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if err := replica2.UpdateLimits(ctx, 3, time.Minute); err != nil {
+		t.Fatalf("Unexpected error updating limits: %v", err)
+	}
+
+	// Idle keys are reported against the new limit
+	if usage := replica2.Usage("user1"); usage.MaxRequests != 3 || usage.Used != 2 || usage.Remaining != 1 {
+		t.Errorf("Expected the usage of the idle key against the new limit, got %+v", usage)
+	}
+
+	allowed, details := replica1.TryAccept(ctx, "user1")
+	if !allowed || details.MaxRequests != 3 {
+		t.Fatalf("Request under the new limit should be allowed, got %v %+v", allowed, details)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	for _, replica := range []*ratebroker.RateBroker{replica1, replica2} {
+		if allowed, _ := replica.TryAccept(ctx, "user1"); allowed {
+			t.Error("Requests recorded before the update should count towards the new limit")
+		}
+		if _, details := replica.TryAccept(ctx, "vip"); details.MaxRequests != 10 {
+			t.Errorf("Keys with a policy should keep it, got %+v", details)
+		}
+	}
+}
+
+func TestRateBroker_InvalidControl(t *testing.T) {
+	rb := ratebroker.NewRateBroker()
+
+	if err := rb.BanKey(context.Background(), "user1", 0); !errors.Is(err, ratebroker.ErrInvalidControl) {
+		t.Errorf("Expected ErrInvalidControl for a ban without a duration, got %v", err)
+	}
+	if err := rb.UpdatePolicy(context.Background(), "user1", 0, time.Minute); !errors.Is(err, ratebroker.ErrInvalidControl) {
+		t.Errorf("Expected ErrInvalidControl for a policy without a limit, got %v", err)
+	}
+	if err := rb.UpdateLimits(context.Background(), 10, 0); !errors.Is(err, ratebroker.ErrInvalidControl) {
+		t.Errorf("Expected ErrInvalidControl for limits without a window, got %v", err)
+	}
+
+	if allowed, _ := rb.TryAccept(context.Background(), "user1"); !allowed {
+		t.Error("Invalid control events should not be applied")
+	}
+}
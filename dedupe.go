@@ -0,0 +1,47 @@
+package ratebroker
+
+import (
+	"sync"
+)
+
+// dedupeWindow remembers the IDs of the most recent events applied to a key so
+// that an event delivered more than once, e.g. when the broker replays its history
+// after a reconnect, is only applied once.
+//
+// It is bounded by size: once full, the oldest ID is forgotten for each new one.
+type dedupeWindow struct {
+	mutex sync.Mutex
+	ids   map[string]struct{}
+	order []string // ring buffer of the IDs in insertion order
+	next  int
+}
+
+func newDedupeWindow(size int) *dedupeWindow {
+	if size < 1 {
+		size = 1
+	}
+
+	return &dedupeWindow{
+		ids:   make(map[string]struct{}, size),
+		order: make([]string, size),
+	}
+}
+
+// add records the ID and reports whether it was not already in the window.
+func (d *dedupeWindow) add(id string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if _, seen := d.ids[id]; seen {
+		return false
+	}
+
+	if oldest := d.order[d.next]; oldest != "" {
+		delete(d.ids, oldest)
+	}
+	d.order[d.next] = id
+	d.next = (d.next + 1) % len(d.order)
+	d.ids[id] = struct{}{}
+
+	return true
+}
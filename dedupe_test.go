@@ -0,0 +1,131 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+// restartingBroker replays its history every time Consume is called and fails the
+// first consumer after it has replayed, like a broker that reconnects.
+type restartingBroker struct {
+	*memoryBroker
+	mu       sync.Mutex
+	restarts int
+}
+
+func (r *restartingBroker) Consume(ctx context.Context, handlerFunc func(ratebroker.Message)) error {
+	r.mu.Lock()
+	fail := r.restarts > 0
+	r.restarts--
+	r.mu.Unlock()
+
+	if fail {
+		r.memoryBroker.mu.Lock()
+		for _, msg := range r.messages {
+			handlerFunc(msg)
+		}
+		r.memoryBroker.mu.Unlock()
+		return errors.New("connection reset")
+	}
+
+	return r.memoryBroker.Consume(ctx, handlerFunc)
+}
+
+// history returns messages accepted by another replica within the last second.
+func history(brokerID string, n int) []ratebroker.Message {
+	messages := make([]ratebroker.Message, n)
+	for i := range messages {
+		messages[i] = ratebroker.Message{
+			ID:        fmt.Sprintf("%s-event-%d", brokerID, i),
+			BrokerID:  brokerID,
+			Event:     ratebroker.RequestAccepted,
+			Timestamp: time.Now().Add(-time.Second),
+			Key:       "user1",
+		}
+	}
+	return messages
+}
+
+// allowedRequests counts how many requests are accepted for the key before it is limited.
+func allowedRequests(rb *ratebroker.RateBroker, key string) int {
+	allowed := 0
+	for i := 0; i < 100; i++ {
+		if ok, _ := rb.TryAccept(context.Background(), key); !ok {
+			break
+		}
+		allowed++
+	}
+	return allowed
+}
+
+func TestRateBroker_DedupeReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := &restartingBroker{memoryBroker: newMemoryBroker(), restarts: 2}
+	broker.replay = true
+	broker.messages = history("replica-2", 3)
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithID("replica-1"),
+		ratebroker.WithMaxRequests(5),
+		ratebroker.WithWindow(time.Minute),
+	)
+	rb.Start(ctx)
+
+	// The history is replayed on every reconnect
+	deadline := time.Now().Add(5 * time.Second)
+	for rb.ConsumerHealth().Restarts < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitForConsumers(t, broker.memoryBroker, 1)
+
+	if allowed := allowedRequests(rb, "user1"); allowed != 2 {
+		t.Errorf("Replayed messages should only be applied once. Want 2 allowed requests, got %d", allowed)
+	}
+}
+
+func TestRateBroker_ReplayAfterRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Messages published by a previous run of this replica and another replica
+	broker := newMemoryBroker()
+	broker.replay = true
+	broker.messages = append(history("replica-1", 2), history("replica-2", 2)...)
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithID("replica-1"),
+		ratebroker.WithMaxRequests(5),
+		ratebroker.WithWindow(time.Minute),
+	)
+	rb.Start(ctx)
+	waitForConsumers(t, broker, 1)
+
+	if allowed := allowedRequests(rb, "user1"); allowed != 1 {
+		t.Errorf("History of a previous run should be applied. Want 1 allowed request, got %d", allowed)
+	}
+
+	// Our own messages published since the start are echoed back but not applied twice
+	time.Sleep(50 * time.Millisecond)
+	for _, msg := range broker.published()[4:] {
+		if msg.ID == "" {
+			t.Error("Published messages should have an event ID")
+		}
+	}
+	if allowed := allowedRequests(rb, "user2"); allowed != 5 {
+		t.Errorf("Own messages should not be applied. Want 5 allowed requests, got %d", allowed)
+	}
+}
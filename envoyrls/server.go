@@ -0,0 +1,155 @@
+// Package envoyrls implements Envoy's rate limit service on top of a RateBroker, so that
+// Envoy can enforce its distributed limits at the proxy layer. Point the ratelimit filter
+// of Envoy at a gRPC server with a Server registered:
+//
+//	grpcServer := grpc.NewServer()
+//	rlsv3.RegisterRateLimitServiceServer(grpcServer, envoyrls.NewServer(rateBroker))
+package envoyrls
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/parkerroan/ratebroker"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+var (
+	errMissingDomain      = errors.New("domain is required")
+	errMissingDescriptors = errors.New("at least one descriptor is required")
+	errEmptyDescriptor    = errors.New("descriptor has no entries")
+)
+
+// KeyFunc maps a descriptor of a request in the domain to the key it is limited by.
+type KeyFunc func(domain string, descriptor *ratelimitv3.RateLimitDescriptor) string
+
+// Server implements rlsv3.RateLimitServiceServer with a RateBroker.
+type Server struct {
+	rb      *ratebroker.RateBroker
+	keyFunc KeyFunc
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithKeyFunc sets how descriptors are mapped to keys, DescriptorKey by default.
+func WithKeyFunc(keyFunc KeyFunc) Option {
+	return func(s *Server) {
+		s.keyFunc = keyFunc
+	}
+}
+
+// NewServer creates a Server checking the descriptors of every request against rb.
+func NewServer(rb *ratebroker.RateBroker, opts ...Option) *Server {
+	s := &Server{
+		rb:      rb,
+		keyFunc: DescriptorKey,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// DescriptorKey maps a descriptor to its domain followed by its entries, e.g.
+// "edge:remote_address=10.0.0.1|path=/login". The domain and the entry keys act as the
+// policy of the key, so the policies of the RateBroker config can match every value of
+// a descriptor by prefix, e.g. "edge:remote_address=*".
+func DescriptorKey(domain string, descriptor *ratelimitv3.RateLimitDescriptor) string {
+	var b strings.Builder
+	b.WriteString(domain)
+	b.WriteByte(':')
+	for i, entry := range descriptor.GetEntries() {
+		if i > 0 {
+			b.WriteByte('|')
+		}
+		b.WriteString(entry.GetKey())
+		b.WriteByte('=')
+		b.WriteString(entry.GetValue())
+	}
+	return b.String()
+}
+
+// ShouldRateLimit implements rlsv3.RateLimitServiceServer. Each descriptor is checked
+// against its own key with a cost of hits_addend, and the request is over the limit as
+// soon as one of them is. Limit overrides in descriptors are ignored, the limits are the
+// policies of the RateBroker.
+func (s *Server) ShouldRateLimit(ctx context.Context, req *rlsv3.RateLimitRequest) (*rlsv3.RateLimitResponse, error) {
+	if req.GetDomain() == "" {
+		return nil, status.Error(codes.InvalidArgument, errMissingDomain.Error())
+	}
+	if len(req.GetDescriptors()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, errMissingDescriptors.Error())
+	}
+	for _, descriptor := range req.GetDescriptors() {
+		if len(descriptor.GetEntries()) == 0 {
+			return nil, status.Error(codes.InvalidArgument, errEmptyDescriptor.Error())
+		}
+	}
+
+	response := &rlsv3.RateLimitResponse{
+		OverallCode: rlsv3.RateLimitResponse_OK,
+		Statuses:    make([]*rlsv3.RateLimitResponse_DescriptorStatus, 0, len(req.GetDescriptors())),
+	}
+	for _, descriptor := range req.GetDescriptors() {
+		key := s.keyFunc(req.GetDomain(), descriptor)
+		result := s.rb.Check(ctx, key, int(req.GetHitsAddend()))
+
+		descriptorStatus := s.descriptorStatus(key, result)
+		if descriptorStatus.Code == rlsv3.RateLimitResponse_OVER_LIMIT {
+			response.OverallCode = rlsv3.RateLimitResponse_OVER_LIMIT
+		}
+		response.Statuses = append(response.Statuses, descriptorStatus)
+	}
+	return response, nil
+}
+
+// descriptorStatus reports the decision for a key with its current limit and usage.
+func (s *Server) descriptorStatus(key string, result ratebroker.CheckResult) *rlsv3.RateLimitResponse_DescriptorStatus {
+	descriptorStatus := &rlsv3.RateLimitResponse_DescriptorStatus{
+		Code: rlsv3.RateLimitResponse_OK,
+		CurrentLimit: &rlsv3.RateLimitResponse_RateLimit{
+			Name:            key + " " + result.Window.String(),
+			RequestsPerUnit: uint32(result.MaxRequests),
+			Unit:            unitOf(result.Window),
+		},
+	}
+	if !result.Allowed {
+		descriptorStatus.Code = rlsv3.RateLimitResponse_OVER_LIMIT
+	}
+
+	usage := s.rb.Usage(key)
+	descriptorStatus.LimitRemaining = uint32(usage.Remaining)
+
+	reset := usage.Reset
+	if !usage.BannedUntil.IsZero() {
+		reset = usage.BannedUntil
+	}
+	if untilReset := reset.Sub(s.rb.Now()); untilReset > 0 {
+		descriptorStatus.DurationUntilReset = durationpb.New(untilReset)
+	}
+	return descriptorStatus
+}
+
+// unitOf returns the unit of a window when it is exactly one, UNKNOWN otherwise. The
+// window is also reported in the name of the limit.
+func unitOf(window time.Duration) rlsv3.RateLimitResponse_RateLimit_Unit {
+	switch window {
+	case time.Second:
+		return rlsv3.RateLimitResponse_RateLimit_SECOND
+	case time.Minute:
+		return rlsv3.RateLimitResponse_RateLimit_MINUTE
+	case time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_HOUR
+	case 24 * time.Hour:
+		return rlsv3.RateLimitResponse_RateLimit_DAY
+	default:
+		return rlsv3.RateLimitResponse_RateLimit_UNKNOWN
+	}
+}
@@ -0,0 +1,138 @@
+//go:build unit
+
+package envoyrls_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	ratelimitv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rlsv3 "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	"github.com/parkerroan/ratebroker"
+	"github.com/parkerroan/ratebroker/envoyrls"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newClient serves the rate limit service of rb over an in-memory listener and connects to it.
+func newClient(t *testing.T, rb *ratebroker.RateBroker) rlsv3.RateLimitServiceClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer()
+	rlsv3.RegisterRateLimitServiceServer(grpcServer, envoyrls.NewServer(rb))
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return rlsv3.NewRateLimitServiceClient(conn)
+}
+
+func descriptor(entries ...string) *ratelimitv3.RateLimitDescriptor {
+	descriptor := &ratelimitv3.RateLimitDescriptor{}
+	for i := 0; i < len(entries); i += 2 {
+		descriptor.Entries = append(descriptor.Entries, &ratelimitv3.RateLimitDescriptor_Entry{Key: entries[i], Value: entries[i+1]})
+	}
+	return descriptor
+}
+
+func TestDescriptorKey(t *testing.T) {
+	key := envoyrls.DescriptorKey("edge", descriptor("remote_address", "10.0.0.1", "path", "/login"))
+	if key != "edge:remote_address=10.0.0.1|path=/login" {
+		t.Errorf("Unexpected key %q", key)
+	}
+}
+
+func TestServer_ShouldRateLimit(t *testing.T) {
+	cfg := &ratebroker.Config{
+		MaxRequests: 3,
+		Window:      ratebroker.Duration(time.Minute),
+		Policies:    []ratebroker.PolicyConfig{{Key: "edge:path=/login*", MaxRequests: 1, Window: ratebroker.Duration(time.Hour)}},
+	}
+	rb := ratebroker.NewRateBroker()
+	if err := rb.ApplyConfig(cfg); err != nil {
+		t.Fatalf("Unexpected error applying config: %v", err)
+	}
+
+	client := newClient(t, rb)
+	ctx := context.Background()
+
+	response, err := client.ShouldRateLimit(ctx, &rlsv3.RateLimitRequest{
+		Domain:      "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("remote_address", "10.0.0.1")},
+		HitsAddend:  2,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Errorf("Expected the request to be allowed, got %v", response)
+	}
+	descriptorStatus := response.GetStatuses()[0]
+	if descriptorStatus.GetLimitRemaining() != 1 || descriptorStatus.GetCurrentLimit().GetRequestsPerUnit() != 3 ||
+		descriptorStatus.GetCurrentLimit().GetUnit() != rlsv3.RateLimitResponse_RateLimit_MINUTE {
+		t.Errorf("Expected 1 of 3 requests per minute remaining, got %v", descriptorStatus)
+	}
+	if untilReset := descriptorStatus.GetDurationUntilReset().AsDuration(); untilReset <= 0 || untilReset > time.Minute {
+		t.Errorf("Expected the limit to reset within the window, got %v", untilReset)
+	}
+
+	// The login policy applies to its own descriptor, the address is still under its limit
+	request := &rlsv3.RateLimitRequest{
+		Domain: "edge",
+		Descriptors: []*ratelimitv3.RateLimitDescriptor{
+			descriptor("remote_address", "10.0.0.2"),
+			descriptor("path", "/login"),
+		},
+	}
+	if response, err := client.ShouldRateLimit(ctx, request); err != nil || response.GetOverallCode() != rlsv3.RateLimitResponse_OK {
+		t.Fatalf("Expected the first login to be allowed, got %v %v", response, err)
+	}
+
+	response, err = client.ShouldRateLimit(ctx, request)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if response.GetOverallCode() != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected the request to be over the limit of the login policy, got %v", response)
+	}
+	if codes := []rlsv3.RateLimitResponse_Code{response.GetStatuses()[0].GetCode(), response.GetStatuses()[1].GetCode()}; codes[0] != rlsv3.RateLimitResponse_OK || codes[1] != rlsv3.RateLimitResponse_OVER_LIMIT {
+		t.Errorf("Expected only the login descriptor to be over its limit, got %v", codes)
+	}
+	if limit := response.GetStatuses()[1].GetCurrentLimit(); limit.GetRequestsPerUnit() != 1 || limit.GetUnit() != rlsv3.RateLimitResponse_RateLimit_HOUR {
+		t.Errorf("Expected the limit of the login policy, got %v", limit)
+	}
+}
+
+func TestServer_InvalidRequests(t *testing.T) {
+	client := newClient(t, ratebroker.NewRateBroker())
+
+	tests := map[string]*rlsv3.RateLimitRequest{
+		"missing domain":      {Descriptors: []*ratelimitv3.RateLimitDescriptor{descriptor("path", "/")}},
+		"missing descriptors": {Domain: "edge"},
+		"empty descriptor":    {Domain: "edge", Descriptors: []*ratelimitv3.RateLimitDescriptor{{}}},
+	}
+
+	for name, request := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := client.ShouldRateLimit(context.Background(), request); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("Expected InvalidArgument, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,198 @@
+package ratebroker
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// wouldLimitMetadata marks the calls that would have been rate limited in shadow mode,
+// like the X-Rate-Limit-Would-Limit header of HttpMiddleware.
+const wouldLimitMetadata = "x-rate-limit-would-limit"
+
+// GRPCKeyFunc returns the key a call to the full method, e.g. "/pkg.Service/Method", is
+// limited by.
+type GRPCKeyFunc func(ctx context.Context, fullMethod string) string
+
+// InterceptorOption configures the gRPC interceptors.
+type InterceptorOption func(*interceptor)
+
+// WithInterceptorKeyFunc sets how the key of a call is extracted, PeerKey by default for
+// the server interceptors and MethodKey for the client ones.
+func WithInterceptorKeyFunc(keyFunc GRPCKeyFunc) InterceptorOption {
+	return func(i *interceptor) {
+		i.keyFunc = keyFunc
+	}
+}
+
+// WithMethodPolicy namespaces the keys of the calls to a method as "policy:key", so the
+// policies of the config can set their limit by prefix with "policy:*". The method is
+// a full method, e.g. "/pkg.Service/Method", or every method of a service with
+// "/pkg.Service/*". Calls to other methods are limited by their key alone.
+func WithMethodPolicy(method, policy string) InterceptorOption {
+	return func(i *interceptor) {
+		i.policies[method] = policy
+	}
+}
+
+// PeerKey returns the IP address of the client, see peer.FromContext.
+func PeerKey(ctx context.Context, _ string) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// MethodKey returns the full method, so that the client interceptors limit the calls
+// to each method.
+func MethodKey(_ context.Context, fullMethod string) string {
+	return fullMethod
+}
+
+// MetadataKey returns a GRPCKeyFunc using the first value of the incoming metadata with
+// the name, e.g. an API key, and the IP address of the client without one.
+func MetadataKey(name string) GRPCKeyFunc {
+	return func(ctx context.Context, fullMethod string) string {
+		if values := metadata.ValueFromIncomingContext(ctx, name); len(values) > 0 && values[0] != "" {
+			return values[0]
+		}
+		return PeerKey(ctx, fullMethod)
+	}
+}
+
+type interceptor struct {
+	rb       *RateBroker
+	keyFunc  GRPCKeyFunc
+	policies map[string]string
+}
+
+func newInterceptor(rb *RateBroker, keyFunc GRPCKeyFunc, opts []InterceptorOption) *interceptor {
+	i := &interceptor{
+		rb:       rb,
+		keyFunc:  keyFunc,
+		policies: make(map[string]string),
+	}
+	for _, opt := range opts {
+		opt(i)
+	}
+	return i
+}
+
+// UnaryServerInterceptor rate limits unary calls with the RateBroker like HttpMiddleware
+// does requests. Calls over the limit fail with codes.ResourceExhausted and RetryInfo
+// details telling the client when to retry.
+func UnaryServerInterceptor(rb *RateBroker, opts ...InterceptorOption) grpc.UnaryServerInterceptor {
+	i := newInterceptor(rb, PeerKey, opts)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		wouldReject, err := i.accept(ctx, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		if wouldReject {
+			grpc.SetHeader(ctx, metadata.Pairs(wouldLimitMetadata, "true"))
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor rate limits streams like UnaryServerInterceptor, counting a
+// request when a stream is opened rather than for each message.
+func StreamServerInterceptor(rb *RateBroker, opts ...InterceptorOption) grpc.StreamServerInterceptor {
+	i := newInterceptor(rb, PeerKey, opts)
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		wouldReject, err := i.accept(ss.Context(), info.FullMethod)
+		if err != nil {
+			return err
+		}
+		if wouldReject {
+			ss.SetHeader(metadata.Pairs(wouldLimitMetadata, "true"))
+		}
+		return handler(srv, ss)
+	}
+}
+
+// UnaryClientInterceptor rate limits outbound unary calls with the RateBroker, e.g. to
+// keep every replica of a service within the quota of an API it calls. Calls over the
+// limit fail without reaching the server, with codes.ResourceExhausted and RetryInfo
+// details like the ones of UnaryServerInterceptor. Calls are limited per method unless
+// WithInterceptorKeyFunc is used.
+func UnaryClientInterceptor(rb *RateBroker, opts ...InterceptorOption) grpc.UnaryClientInterceptor {
+	i := newInterceptor(rb, MethodKey, opts)
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, callOpts ...grpc.CallOption) error {
+		if _, err := i.accept(ctx, method); err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, callOpts...)
+	}
+}
+
+// StreamClientInterceptor rate limits outbound streams like UnaryClientInterceptor,
+// counting a request when a stream is opened rather than for each message.
+func StreamClientInterceptor(rb *RateBroker, opts ...InterceptorOption) grpc.StreamClientInterceptor {
+	i := newInterceptor(rb, MethodKey, opts)
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, callOpts ...grpc.CallOption) (grpc.ClientStream, error) {
+		if _, err := i.accept(ctx, method); err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, callOpts...)
+	}
+}
+
+// accept checks a call to the method, returning a ResourceExhausted error when it is
+// rejected and whether it would have been in shadow mode.
+func (i *interceptor) accept(ctx context.Context, method string) (bool, error) {
+	key := i.keyFunc(ctx, method)
+	if policy := i.policyFor(method); policy != "" {
+		key = policy + ":" + key
+	}
+
+	allowed, details := i.rb.TryAccept(ctx, key)
+	if allowed {
+		return details.WouldReject, nil
+	}
+
+	st := status.Newf(codes.ResourceExhausted, "rate limit exceeded: %d requests per %v", details.MaxRequests, details.Window)
+	if withDetails, err := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(i.retryDelay(key, details))}); err == nil {
+		st = withDetails
+	}
+	return false, st.Err()
+}
+
+// policyFor returns the policy of the method, or of its service.
+func (i *interceptor) policyFor(method string) string {
+	if policy, ok := i.policies[method]; ok {
+		return policy
+	}
+	if slash := strings.LastIndexByte(method, '/'); slash >= 0 {
+		return i.policies[method[:slash+1]+"*"]
+	}
+	return ""
+}
+
+// retryDelay returns how long until the key is no longer banned or its oldest request
+// leaves the window, or the whole window when the limiter does not report it.
+func (i *interceptor) retryDelay(key string, details LimitDetails) time.Duration {
+	now := i.rb.Now()
+	if !details.BannedUntil.IsZero() {
+		return max(details.BannedUntil.Sub(now), 0)
+	}
+	if reset := i.rb.Usage(key).Reset; !reset.IsZero() {
+		return max(reset.Sub(now), 0)
+	}
+	return details.Window
+}
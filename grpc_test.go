@@ -0,0 +1,191 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// newHealthClient serves the gRPC health service behind the server interceptors and
+// connects to it.
+func newHealthClient(t *testing.T, rb *ratebroker.RateBroker, opts ...ratebroker.InterceptorOption) grpc_health_v1.HealthClient {
+	t.Helper()
+
+	return dialHealthServer(t, []grpc.ServerOption{
+		grpc.UnaryInterceptor(ratebroker.UnaryServerInterceptor(rb, opts...)),
+		grpc.StreamInterceptor(ratebroker.StreamServerInterceptor(rb, opts...)),
+	})
+}
+
+// dialHealthServer serves the gRPC health service with the server options over an
+// in-memory listener and connects to it with the dial options.
+func dialHealthServer(t *testing.T, serverOpts []grpc.ServerOption, dialOpts ...grpc.DialOption) grpc_health_v1.HealthClient {
+	t.Helper()
+
+	listener := bufconn.Listen(1 << 20)
+	grpcServer := grpc.NewServer(serverOpts...)
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewServer())
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+
+	dialOpts = append(dialOpts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	conn, err := grpc.NewClient("passthrough:///bufnet", dialOpts...)
+	if err != nil {
+		t.Fatalf("Unexpected error connecting: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return grpc_health_v1.NewHealthClient(conn)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+	)
+	client := newHealthClient(t, rb, ratebroker.WithInterceptorKeyFunc(ratebroker.MetadataKey("x-api-key")))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key1")
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Expected the first call to be allowed, got %v", err)
+	}
+
+	_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	st := status.Convert(err)
+	if st.Code() != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted over the limit, got %v", err)
+	}
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retryInfo = info
+		}
+	}
+	if retryInfo == nil {
+		t.Fatalf("Expected RetryInfo details, got %v", st.Details())
+	}
+	if delay := retryInfo.GetRetryDelay().AsDuration(); delay <= 0 || delay > time.Minute {
+		t.Errorf("Expected a retry delay within the window, got %v", delay)
+	}
+
+	if keys := rb.Keys(); len(keys) != 1 || keys[0] != "key1" {
+		t.Errorf("Expected the call to be limited by its API key, got %v", keys)
+	}
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "key2")
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Errorf("Expected another API key to have its own limit, got %v", err)
+	}
+}
+
+func TestStreamServerInterceptor_MethodPolicy(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(5),
+		ratebroker.WithWindow(time.Minute),
+	)
+	cfg := &ratebroker.Config{
+		Policies: []ratebroker.PolicyConfig{{Key: "watch:*", MaxRequests: 1, Window: ratebroker.Duration(time.Minute)}},
+	}
+	if err := rb.ApplyConfig(cfg); err != nil {
+		t.Fatalf("Unexpected error applying config: %v", err)
+	}
+	client := newHealthClient(t, rb, ratebroker.WithMethodPolicy("/grpc.health.v1.Health/Watch", "watch"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error opening stream: %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Expected the first stream to be allowed, got %v", err)
+	}
+
+	stream, err = client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Unexpected error opening stream: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the watch policy to be enforced, got %v", err)
+	}
+
+	// Unary calls are not in the watch policy and have the default limit
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Errorf("Expected Check to have its own limit, got %v", err)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+	)
+
+	// Count the calls that reach the server
+	var calls atomic.Int32
+	client := dialHealthServer(t,
+		[]grpc.ServerOption{
+			grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				calls.Add(1)
+				return handler(ctx, req)
+			}),
+			grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				calls.Add(1)
+				return handler(srv, ss)
+			}),
+		},
+		grpc.WithUnaryInterceptor(ratebroker.UnaryClientInterceptor(rb)),
+		grpc.WithStreamInterceptor(ratebroker.StreamClientInterceptor(rb)),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if _, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}); err != nil {
+		t.Fatalf("Expected the first call to be allowed, got %v", err)
+	}
+	_, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Expected ResourceExhausted over the limit, got %v", err)
+	}
+	if details := status.Convert(err).Details(); len(details) != 1 {
+		t.Errorf("Expected RetryInfo details, got %v", details)
+	}
+
+	// Calls are limited per method, so Watch has its own limit
+	stream, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	if err != nil {
+		t.Fatalf("Expected the first stream to be allowed, got %v", err)
+	}
+	if _, err := stream.Recv(); err != nil {
+		t.Fatalf("Unexpected error receiving: %v", err)
+	}
+	if _, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("Expected the second stream to be rejected, got %v", err)
+	}
+
+	if n := calls.Load(); n != 2 {
+		t.Errorf("Expected only the allowed calls to reach the server, got %d", n)
+	}
+}
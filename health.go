@@ -0,0 +1,81 @@
+package ratebroker
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ConsumerHealth describes the state of the RateBroker's message consumer.
+type ConsumerHealth struct {
+	Ready       bool          `json:"ready"`         // Whether the RateBroker is ready, see Ready
+	Consuming   bool          `json:"consuming"`     // Whether the broker's Consume is currently running
+	Restarts    int           `json:"restarts"`      // Number of times Consume was restarted after returning an error
+	LastError   string        `json:"last_error"`    // The last error returned by Consume
+	LastErrorAt time.Time     `json:"last_error_at"` // When the last error was returned
+	Stats       ConsumerStats `json:"stats"`         // Counters reported by the broker if it implements StatsReporter
+}
+
+// ConsumerHealth reports the state of the message consumer started by Start.
+func (rb *RateBroker) ConsumerHealth() ConsumerHealth {
+	rb.healthMutex.Lock()
+	health := rb.health
+	rb.healthMutex.Unlock()
+
+	health.Ready = rb.IsReady()
+	if reporter, ok := rb.broker.(StatsReporter); ok {
+		health.Stats = reporter.ConsumerStats()
+	}
+
+	return health
+}
+
+// Healthy reports whether the RateBroker is consuming messages from its broker.
+// A RateBroker without a broker is always healthy.
+func (rb *RateBroker) Healthy() bool {
+	if rb.broker == nil {
+		return true
+	}
+
+	return rb.ConsumerHealth().Consuming
+}
+
+func (rb *RateBroker) setConsuming(consuming bool, err error) {
+	rb.healthMutex.Lock()
+	defer rb.healthMutex.Unlock()
+
+	rb.health.Consuming = consuming
+	if err != nil {
+		rb.health.LastError = err.Error()
+		rb.health.LastErrorAt = time.Now()
+	}
+}
+
+// ReadinessHandler returns an http.Handler suitable for a readiness probe.
+// It responds with 200 once the RateBroker is ready and 503 until then, so
+// that a replica does not receive traffic while its limiters are still cold.
+func ReadinessHandler(rb *RateBroker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !rb.IsReady() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Write([]byte("ok"))
+	})
+}
+
+// HealthHandler returns an http.Handler that responds with the ConsumerHealth as JSON.
+// The status is 200 while the RateBroker is healthy and 503 otherwise.
+func HealthHandler(rb *RateBroker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := http.StatusOK
+		if !rb.Healthy() {
+			status = http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(rb.ConsumerHealth())
+	})
+}
@@ -0,0 +1,108 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+func TestReadinessHandler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	rb := ratebroker.NewRateBroker(ratebroker.WithBroker(broker))
+	handler := ratebroker.ReadinessHandler(rb)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d before start, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+
+	rb.Start(ctx)
+	if rb.IsReady() {
+		t.Error("RateBroker should not be ready before the broker has replayed its history")
+	}
+
+	close(broker.ready)
+	select {
+	case <-rb.Ready():
+	case <-time.After(time.Second):
+		t.Fatal("RateBroker did not become ready after the broker replayed its history")
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d after replay, got %d", http.StatusOK, rec.Code)
+	}
+}
+
+func TestReadiness_LocalInstance(t *testing.T) {
+	rb := ratebroker.NewRateBroker()
+
+	if !rb.IsReady() {
+		t.Error("RateBroker without a broker should be ready immediately")
+	}
+}
+
+// failingBroker returns an error from the first failures calls to Consume and then consumes until the context is done.
+type failingBroker struct {
+	*memoryBroker
+	mu       sync.Mutex
+	failures int
+}
+
+func (f *failingBroker) Consume(ctx context.Context, handlerFunc func(ratebroker.Message)) error {
+	f.mu.Lock()
+	if f.failures > 0 {
+		f.failures--
+		f.mu.Unlock()
+		return errors.New("connection lost")
+	}
+	f.mu.Unlock()
+
+	return f.memoryBroker.Consume(ctx, handlerFunc)
+}
+
+func TestConsumerHealth_Restart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := &failingBroker{memoryBroker: newMemoryBroker(), failures: 2}
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(ratebroker.WithBroker(broker))
+	rb.Start(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rb.ConsumerHealth().Restarts < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	health := rb.ConsumerHealth()
+	if health.Restarts != 2 {
+		t.Fatalf("Expected the consumer to be restarted 2 times, got %d", health.Restarts)
+	}
+	if !health.Consuming {
+		t.Error("Consumer should be running after being restarted")
+	}
+	if health.LastError != "connection lost" {
+		t.Errorf("Expected the last error to be reported, got %q", health.LastError)
+	}
+
+	rec := httptest.NewRecorder()
+	ratebroker.HealthHandler(rb).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Expected status %d while consuming, got %d", http.StatusOK, rec.Code)
+	}
+}
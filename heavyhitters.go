@@ -0,0 +1,162 @@
+package ratebroker
+
+import (
+	"container/heap"
+	"sort"
+	"sync"
+)
+
+// HeavyHitter is a key with its estimated number of requests, see HeavyHitters.
+type HeavyHitter struct {
+	Key   string `json:"key"`   // The key as stored, see StoredKey
+	Count uint64 `json:"count"` // Estimated number of requests, never lower than the actual number
+	Error uint64 `json:"error"` // Maximum overestimation of Count
+}
+
+// TopKeys are the keys with the most requests, see HeavyHitters.
+type TopKeys struct {
+	Accepted []HeavyHitter `json:"accepted"` // Allowed by this replica or accepted by another one
+	Rejected []HeavyHitter `json:"rejected"` // Rejected by this replica
+}
+
+// WithHeavyHitters tracks the keys with the most accepted and rejected requests, see
+// HeavyHitters, using the Space-Saving algorithm with capacity counters for each. The
+// memory used is fixed, and any key with more than 1/capacity of the requests is
+// guaranteed to be reported, so the capacity should be a few times the number of keys
+// of interest. Accepted requests include those accepted by other replicas.
+func WithHeavyHitters(capacity int) Option {
+	return func(rb *RateBroker) {
+		rb.heavyHitters = &heavyHitters{
+			accepted: newSpaceSaving(capacity),
+			rejected: newSpaceSaving(capacity),
+		}
+	}
+}
+
+// HeavyHitters returns the n keys with the most accepted and rejected requests since
+// the RateBroker was created, most requests first. It returns no keys unless
+// WithHeavyHitters is used, or when n is not positive.
+func (rb *RateBroker) HeavyHitters(n int) TopKeys {
+	if rb.heavyHitters == nil {
+		return TopKeys{}
+	}
+
+	return TopKeys{
+		Accepted: rb.heavyHitters.accepted.top(n),
+		Rejected: rb.heavyHitters.rejected.top(n),
+	}
+}
+
+// heavyHitters holds the sketches of accepted and rejected requests.
+type heavyHitters struct {
+	accepted *spaceSaving
+	rejected *spaceSaving
+}
+
+// spaceSaving counts the most frequent keys with a fixed number of counters. When every
+// counter is in use, a new key takes over the counter with the lowest count, inheriting
+// its count as its error.
+type spaceSaving struct {
+	mutex    sync.Mutex
+	capacity int
+	counters map[string]*spaceSavingCounter
+	heap     spaceSavingHeap // Min-heap by count
+}
+
+type spaceSavingCounter struct {
+	key   string
+	count uint64
+	error uint64
+	index int
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{
+		capacity: capacity,
+		counters: make(map[string]*spaceSavingCounter, capacity),
+		heap:     make(spaceSavingHeap, 0, capacity),
+	}
+}
+
+// add counts n requests for the key.
+func (s *spaceSaving) add(key string, n uint64) {
+	if s.capacity <= 0 {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if counter, ok := s.counters[key]; ok {
+		counter.count += n
+		heap.Fix(&s.heap, counter.index)
+		return
+	}
+
+	if len(s.heap) < s.capacity {
+		counter := &spaceSavingCounter{key: key, count: n}
+		s.counters[key] = counter
+		heap.Push(&s.heap, counter)
+		return
+	}
+
+	counter := s.heap[0]
+	delete(s.counters, counter.key)
+	counter.key = key
+	counter.error = counter.count
+	counter.count += n
+	s.counters[key] = counter
+	heap.Fix(&s.heap, counter.index)
+}
+
+// top returns the n counters with the highest count, ties sorted by key.
+func (s *spaceSaving) top(n int) []HeavyHitter {
+	if n <= 0 {
+		return nil
+	}
+
+	s.mutex.Lock()
+	hitters := make([]HeavyHitter, 0, len(s.heap))
+	for _, counter := range s.heap {
+		hitters = append(hitters, HeavyHitter{Key: counter.key, Count: counter.count, Error: counter.error})
+	}
+	s.mutex.Unlock()
+
+	sort.Slice(hitters, func(i, j int) bool {
+		if hitters[i].Count != hitters[j].Count {
+			return hitters[i].Count > hitters[j].Count
+		}
+		return hitters[i].Key < hitters[j].Key
+	})
+	if len(hitters) > n {
+		hitters = hitters[:n]
+	}
+	return hitters
+}
+
+// spaceSavingHeap implements heap.Interface ordered by count.
+type spaceSavingHeap []*spaceSavingCounter
+
+func (h spaceSavingHeap) Len() int           { return len(h) }
+func (h spaceSavingHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h spaceSavingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *spaceSavingHeap) Push(x interface{}) {
+	counter := x.(*spaceSavingCounter)
+	counter.index = len(*h)
+	*h = append(*h, counter)
+}
+
+func (h *spaceSavingHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	counter := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return counter
+}
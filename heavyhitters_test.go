@@ -0,0 +1,107 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+func TestRateBroker_HeavyHitters(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	newReplica := func() *ratebroker.RateBroker {
+		rb := ratebroker.NewRateBroker(
+			ratebroker.WithBroker(broker),
+			ratebroker.WithMaxRequests(20),
+			ratebroker.WithWindow(time.Minute),
+			ratebroker.WithHeavyHitters(3),
+		)
+		rb.Start(ctx)
+		return rb
+	}
+	replica1, replica2 := newReplica(), newReplica()
+	waitForConsumers(t, broker, 2)
+
+	// The hot key is interleaved with more distinct keys than there are counters
+	for i := 0; i < 30; i++ {
+		replica1.TryAccept(ctx, "hot")
+		replica1.TryAccept(ctx, fmt.Sprintf("cold%d", i))
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	for name, replica := range map[string]*ratebroker.RateBroker{"local": replica1, "remote": replica2} {
+		top := replica.HeavyHitters(2)
+		if len(top.Accepted) != 2 || top.Accepted[0].Key != "hot" {
+			t.Fatalf("%s: expected the hot key first, got %+v", name, top.Accepted)
+		}
+		if hot := top.Accepted[0]; hot.Count < 20 || hot.Count-hot.Error > 20 {
+			t.Errorf("%s: expected an estimate bounding the 20 accepted requests, got %+v", name, hot)
+		}
+	}
+
+	top := replica1.HeavyHitters(5)
+	if len(top.Rejected) != 1 || top.Rejected[0] != (ratebroker.HeavyHitter{Key: "hot", Count: 10}) {
+		t.Errorf("Expected the 10 rejected requests of the hot key, got %+v", top.Rejected)
+	}
+	if len(replica2.HeavyHitters(5).Rejected) != 0 {
+		t.Error("Rejections should only be counted by the replica rejecting them")
+	}
+	if top := replica1.HeavyHitters(-1); len(top.Accepted) != 0 || len(top.Rejected) != 0 {
+		t.Errorf("Expected no heavy hitters for a negative n, got %+v", top)
+	}
+}
+
+func TestRateBroker_HeavyHittersDisabled(t *testing.T) {
+	rb := ratebroker.NewRateBroker()
+	rb.TryAccept(context.Background(), "user1")
+
+	if top := rb.HeavyHitters(10); len(top.Accepted) != 0 || len(top.Rejected) != 0 {
+		t.Errorf("Expected no heavy hitters without WithHeavyHitters, got %+v", top)
+	}
+}
+
+func TestPrometheusMetrics_HeavyHitters(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithHeavyHitters(10),
+	)
+	rb.TryAccept(context.Background(), "user1")
+	rb.TryAccept(context.Background(), "user1")
+
+	rec := httptest.NewRecorder()
+	ratebroker.NewPrometheusMetrics().Handler(rb).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, want := range []string{
+		`ratebroker_top_key_requests{decision="accepted",key="user1"} 1`,
+		`ratebroker_top_key_requests{decision="rejected",key="user1"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected %q in the metrics, got:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestPrometheusMetrics_HostileKey(t *testing.T) {
+	rb := ratebroker.NewRateBroker(ratebroker.WithHeavyHitters(10))
+	rb.TryAccept(context.Background(), "a\tb\u00ad\xff\"c\\d\ne")
+
+	rec := httptest.NewRecorder()
+	ratebroker.NewPrometheusMetrics().Handler(rb).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	// Only backslashes, double quotes and line feeds are escaped, invalid UTF-8 is replaced
+	want := "ratebroker_top_key_requests{decision=\"accepted\",key=\"a\tb\u00ad\uFFFD\\\"c\\\\d\\ne\"} 1\n"
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("Expected %q in the metrics, got:\n%s", want, rec.Body.String())
+	}
+}
@@ -0,0 +1,60 @@
+package ratebroker
+
+import "time"
+
+// HookFunc is a callback receiving the key, its limit and when the event occurred, see OnAccept.
+//
+// Hooks are called synchronously, on the goroutine calling TryAccept or consuming from
+// the broker, so they must be safe for concurrent use and should not block.
+type HookFunc func(key string, details LimitDetails, timestamp time.Time)
+
+// hooks holds the callbacks registered by OnAccept, OnReject, OnRemoteApply and OnEvict.
+type hooks struct {
+	accept      []HookFunc
+	reject      []HookFunc
+	remoteApply []HookFunc
+	evict       []HookFunc
+}
+
+// OnAccept calls hook for every request allowed by TryAccept with the key passed to
+// TryAccept. This includes requests allowed by the allow list and, in shadow mode,
+// requests that would have been rejected, see LimitDetails.WouldReject.
+// The option can be passed multiple times to register several hooks.
+func OnAccept(hook HookFunc) Option {
+	return func(rb *RateBroker) {
+		rb.hooks.accept = append(rb.hooks.accept, hook)
+	}
+}
+
+// OnReject calls hook for every request rejected by TryAccept with the key passed to
+// TryAccept, whether it was over the limit, banned or denied.
+// The option can be passed multiple times to register several hooks.
+func OnReject(hook HookFunc) Option {
+	return func(rb *RateBroker) {
+		rb.hooks.reject = append(rb.hooks.reject, hook)
+	}
+}
+
+// OnRemoteApply calls hook for every request accepted by another replica once it is
+// counted by this one, with the key as broadcast, see StoredKey, and the timestamp of
+// the request. The option can be passed multiple times to register several hooks.
+func OnRemoteApply(hook HookFunc) Option {
+	return func(rb *RateBroker) {
+		rb.hooks.remoteApply = append(rb.hooks.remoteApply, hook)
+	}
+}
+
+// OnEvict calls hook when the limiter of a key is dropped from the cache, because it
+// was evicted or reset by ResetKey, with the key as stored, see StoredKey.
+// The option can be passed multiple times to register several hooks.
+func OnEvict(hook HookFunc) Option {
+	return func(rb *RateBroker) {
+		rb.hooks.evict = append(rb.hooks.evict, hook)
+	}
+}
+
+func callHooks(hooks []HookFunc, key string, details LimitDetails, timestamp time.Time) {
+	for _, hook := range hooks {
+		hook(key, details, timestamp)
+	}
+}
@@ -0,0 +1,99 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+// hookRecorder records the calls to a HookFunc.
+type hookRecorder struct {
+	mu    sync.Mutex
+	calls []hookCall
+}
+
+type hookCall struct {
+	key       string
+	details   ratebroker.LimitDetails
+	timestamp time.Time
+}
+
+func (r *hookRecorder) hook(key string, details ratebroker.LimitDetails, timestamp time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, hookCall{key, details, timestamp})
+}
+
+func (r *hookRecorder) recorded() []hookCall {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]hookCall(nil), r.calls...)
+}
+
+func TestRateBroker_Hooks(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	var accepted, rejected, applied, evicted hookRecorder
+	newReplica := func(opts ...ratebroker.Option) *ratebroker.RateBroker {
+		rb := ratebroker.NewRateBroker(append([]ratebroker.Option{
+			ratebroker.WithBroker(broker),
+			ratebroker.WithMaxRequests(1),
+			ratebroker.WithWindow(time.Minute),
+		}, opts...)...)
+		rb.Start(ctx)
+		return rb
+	}
+
+	replica1 := newReplica(
+		ratebroker.OnAccept(accepted.hook),
+		ratebroker.OnReject(rejected.hook),
+		ratebroker.OnEvict(evicted.hook),
+	)
+	replica2 := newReplica(ratebroker.OnRemoteApply(applied.hook))
+	waitForConsumers(t, broker, 2)
+
+	before := time.Now()
+	replica1.TryAccept(ctx, "user1")
+	replica1.TryAccept(ctx, "user1")
+	time.Sleep(20 * time.Millisecond)
+
+	if calls := accepted.recorded(); len(calls) != 1 || calls[0].key != "user1" || calls[0].details.MaxRequests != 1 || calls[0].timestamp.Before(before) {
+		t.Errorf("Expected OnAccept to be called for the first request, got %+v", calls)
+	}
+	if calls := rejected.recorded(); len(calls) != 1 || calls[0].key != "user1" {
+		t.Errorf("Expected OnReject to be called for the second request, got %+v", calls)
+	}
+	if calls := applied.recorded(); len(calls) != 1 || calls[0].key != "user1" || calls[0].details.Window != time.Minute {
+		t.Errorf("Expected OnRemoteApply to be called on the other replica, got %+v", calls)
+	}
+
+	if err := replica2.ResetKey(ctx, "user1"); err != nil {
+		t.Fatalf("Unexpected error resetting key: %v", err)
+	}
+	if calls := evicted.recorded(); len(calls) != 1 || calls[0].key != "user1" {
+		t.Errorf("Expected OnEvict to be called when the key is reset, got %+v", calls)
+	}
+}
+
+func TestRateBroker_HooksMultiple(t *testing.T) {
+	var first, second hookRecorder
+	rb := ratebroker.NewRateBroker(
+		ratebroker.OnAccept(first.hook),
+		ratebroker.OnAccept(second.hook),
+	)
+
+	rb.TryAccept(context.Background(), "user1")
+
+	if len(first.recorded()) != 1 || len(second.recorded()) != 1 {
+		t.Error("Expected every OnAccept hook to be called")
+	}
+}
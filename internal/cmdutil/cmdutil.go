@@ -0,0 +1,73 @@
+// Package cmdutil holds the setup shared by the ratebroker commands: the Redis client,
+// the broker ID, message signing and the admin server.
+package cmdutil
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/parkerroan/ratebroker"
+)
+
+// ErrInvalidSigningKey is returned for a signing key that is not an id=secret pair.
+var ErrInvalidSigningKey = errors.New("invalid signing key, expected id=secret")
+
+// NewRedisClient connects to Redis. A single address connects to a single node,
+// multiple comma separated addresses to a Cluster and a master name to Sentinel.
+func NewRedisClient(addrs, masterName string) redis.UniversalClient {
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      strings.Split(addrs, ","),
+		MasterName: masterName,
+	})
+}
+
+// BrokerID returns the ID, the hostname if empty.
+func BrokerID(id string) (string, error) {
+	if id != "" {
+		return id, nil
+	}
+	return os.Hostname()
+}
+
+// LoadBrokerOptions returns the broker options of the ratebroker config file.
+func LoadBrokerOptions(file string) ([]func(*ratebroker.RedisMessageBroker), error) {
+	cfg, err := ratebroker.LoadConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.Broker.Options()
+}
+
+// WithSigningKeys wraps the broker with a SigningBroker using id=secret pairs, the
+// first key signs messages and all of them are accepted. The broker is returned as
+// is without keys.
+func WithSigningKeys(broker ratebroker.MessageBroker, keys []string) (ratebroker.MessageBroker, error) {
+	var signer *ratebroker.SigningBroker
+	for _, pair := range keys {
+		id, secret, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, ErrInvalidSigningKey
+		}
+
+		if signer == nil {
+			signer = ratebroker.NewSigningBroker(broker, id, []byte(secret))
+			continue
+		}
+		signer.AddKey(id, []byte(secret))
+	}
+
+	if signer == nil {
+		return broker, nil
+	}
+	return signer, nil
+}
+
+// NewAdminServer returns the server of the admin handler on the port. The admin API
+// is not authenticated, so it is served on its own port kept off the public network.
+func NewAdminServer(port int, handler http.Handler) *http.Server {
+	return &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: handler}
+}
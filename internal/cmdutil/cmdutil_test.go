@@ -0,0 +1,31 @@
+//go:build unit
+
+package cmdutil
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+func TestWithSigningKeys(t *testing.T) {
+	var broker ratebroker.MessageBroker = ratebroker.NewRedisMessageBroker(nil)
+
+	signed, err := WithSigningKeys(broker, nil)
+	if err != nil || signed != broker {
+		t.Errorf("Expected the broker without keys, got %v, %v", signed, err)
+	}
+
+	signed, err = WithSigningKeys(broker, []string{"v2=new", "v1=old"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := signed.(*ratebroker.SigningBroker); !ok {
+		t.Errorf("Expected a SigningBroker, got %T", signed)
+	}
+
+	if _, err := WithSigningKeys(broker, []string{"v1=old", "v2"}); !errors.Is(err, ErrInvalidSigningKey) {
+		t.Errorf("Expected ErrInvalidSigningKey, got %v", err)
+	}
+}
@@ -104,11 +104,59 @@ func (hl *HeapLimiter) TryAccept(now time.Time) bool {
 	return false
 }
 
+// TryAcceptN checks if n requests are within the rate limits and adds them to the heap.
+func (hl *HeapLimiter) TryAcceptN(now time.Time, n int) bool {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+
+	if !hl.try(now) || hl.pq.Len()+n > hl.size {
+		return false
+	}
+
+	for i := 0; i < n; i++ {
+		hl.accept(now)
+	}
+	return true
+}
+
 // LimitDetails returns the size and window of the limiter.
 func (hl *HeapLimiter) LimitDetails() (int, time.Duration) {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
 	return hl.size, hl.window
 }
 
+// Resize changes the size and window of the limiter, every recorded request is kept.
+func (hl *HeapLimiter) Resize(size int, window time.Duration) {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+	hl.size = size
+	hl.window = window
+}
+
+// Usage returns the number of requests in the window ending at now and when the oldest of them leaves it.
+func (hl *HeapLimiter) Usage(now time.Time) (int, time.Time) {
+	hl.mutex.Lock()
+	defer hl.mutex.Unlock()
+
+	var used int
+	var oldest time.Time
+	for _, item := range hl.pq {
+		if now.Sub(item.timestamp) > hl.window {
+			continue
+		}
+		used++
+		if oldest.IsZero() || item.timestamp.Before(oldest) {
+			oldest = item.timestamp
+		}
+	}
+
+	if used == 0 {
+		return 0, time.Time{}
+	}
+	return used, oldest.Add(hl.window)
+}
+
 func (hl *HeapLimiter) accept(now time.Time) {
 	item := &item{
 		timestamp: now,
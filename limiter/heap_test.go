@@ -33,3 +33,70 @@ func TestHeapLimiter_TryAccept(t *testing.T) {
 		t.Error("Fourth request should be allowed after waiting 1 second")
 	}
 }
+
+func TestHeapLimiter_Resize(t *testing.T) {
+	now := time.Now()
+	hl := NewHeapLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		hl.Accept(now.Add(time.Duration(i) * time.Second))
+	}
+
+	hl.Resize(4, time.Minute)
+	if size, window := hl.LimitDetails(); size != 4 || window != time.Minute {
+		t.Fatalf("Expected size 4 and window 1m, got %d and %v", size, window)
+	}
+	if !hl.TryAccept(now.Add(3 * time.Second)) {
+		t.Fatal("Request up to the new size should be allowed")
+	}
+	if hl.TryAccept(now.Add(4 * time.Second)) {
+		t.Fatal("Requests recorded before the resize should count towards the new size")
+	}
+
+	// Shrinking the window drops the requests outside of it
+	hl.Resize(4, 2*time.Second)
+	if !hl.TryAccept(now.Add(4*time.Second + time.Millisecond)) {
+		t.Error("Requests outside of the new window should not count")
+	}
+}
+
+func TestHeapLimiter_Usage(t *testing.T) {
+	now := time.Now()
+	hl := NewHeapLimiter(3, time.Minute)
+
+	if used, reset := hl.Usage(now); used != 0 || !reset.IsZero() {
+		t.Fatalf("Expected no usage, got %d and %v", used, reset)
+	}
+
+	hl.Accept(now)
+	hl.Accept(now.Add(-2 * time.Minute))
+	hl.Accept(now.Add(-30 * time.Second))
+
+	used, reset := hl.Usage(now)
+	if used != 2 {
+		t.Errorf("Expected the 2 requests in the window, got %d", used)
+	}
+	if want := now.Add(30 * time.Second); !reset.Equal(want) {
+		t.Errorf("Expected the oldest request to leave the window at %v, got %v", want, reset)
+	}
+}
+
+func TestHeapLimiter_TryAcceptN(t *testing.T) {
+	now := time.Now()
+	hl := NewHeapLimiter(5, time.Minute)
+
+	if hl.TryAcceptN(now, 6) {
+		t.Fatal("Requests over the size should never be allowed")
+	}
+	if !hl.TryAcceptN(now, 3) {
+		t.Fatal("Requests within the limit should be allowed")
+	}
+	if hl.TryAcceptN(now, 3) {
+		t.Fatal("Requests over the remaining limit should be rejected")
+	}
+	if !hl.TryAcceptN(now, 2) {
+		t.Fatal("Requests up to the remaining limit should be allowed")
+	}
+	if !hl.TryAcceptN(now.Add(time.Minute+time.Millisecond), 5) {
+		t.Error("Requests should be allowed once the window passed")
+	}
+}
@@ -15,3 +15,24 @@ type Limiter interface {
 	// LimitDetails returns the size and window of the limiter.
 	LimitDetails() (int, time.Duration)
 }
+
+// Resizer is implemented by limiters whose size and window can be changed
+// without losing the requests they recorded.
+type Resizer interface {
+	// Resize changes the size and window of the limiter.
+	Resize(size int, window time.Duration)
+}
+
+// CostLimiter is implemented by limiters that can count several requests at once.
+type CostLimiter interface {
+	// TryAcceptN checks if n requests are within the rate limits and logs them to the
+	// limiter if they are, otherwise none of them is logged.
+	TryAcceptN(now time.Time, n int) bool
+}
+
+// UsageReporter is implemented by limiters that can report the requests they recorded.
+type UsageReporter interface {
+	// Usage returns the number of requests recorded in the window ending at now and
+	// when the oldest of them leaves the window, zero if there are none.
+	Usage(now time.Time) (used int, reset time.Time)
+}
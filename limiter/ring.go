@@ -63,11 +63,85 @@ func (rl *RingLimiter) TryAccept(now time.Time) bool {
 	return false
 }
 
+// TryAcceptN checks if n requests are within the rate limits and adds them to the ring buffer.
+func (rl *RingLimiter) TryAcceptN(now time.Time, n int) bool {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	if n > rl.size {
+		return false
+	}
+
+	// The current position holds the oldest request, so n requests fit if the n-th oldest expired
+	oldestAllowedTime := now.Add(-rl.window)
+	if nth := rl.ring.Move(n - 1); nth.Value != nil && !nth.Value.(time.Time).Before(oldestAllowedTime) {
+		return false
+	}
+
+	for i := 0; i < n; i++ {
+		rl.accept(now)
+	}
+	return true
+}
+
 // LimitDetails returns the size and window of the limiter.
 func (rl *RingLimiter) LimitDetails() (int, time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
 	return rl.size, rl.window
 }
 
+// Resize changes the size and window of the limiter. The most recent requests
+// that fit in the new size are kept.
+func (rl *RingLimiter) Resize(size int, window time.Duration) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	// The current position holds the oldest request, or nothing if the ring is not full yet
+	var timestamps []time.Time
+	rl.ring.Do(func(value any) {
+		if value != nil {
+			timestamps = append(timestamps, value.(time.Time))
+		}
+	})
+	if len(timestamps) > size {
+		timestamps = timestamps[len(timestamps)-size:]
+	}
+
+	rl.ring = ring.New(size)
+	rl.size = size
+	rl.window = window
+	for _, timestamp := range timestamps {
+		rl.accept(timestamp)
+	}
+}
+
+// Usage returns the number of requests in the window ending at now and when the oldest of them leaves it.
+func (rl *RingLimiter) Usage(now time.Time) (int, time.Time) {
+	rl.mutex.Lock()
+	defer rl.mutex.Unlock()
+
+	oldestAllowedTime := now.Add(-rl.window)
+
+	var used int
+	var oldest time.Time
+	rl.ring.Do(func(value any) {
+		if value == nil || value.(time.Time).Before(oldestAllowedTime) {
+			return
+		}
+		used++
+		if timestamp := value.(time.Time); oldest.IsZero() || timestamp.Before(oldest) {
+			oldest = timestamp
+		}
+	})
+
+	if used == 0 {
+		return 0, time.Time{}
+	}
+	return used, oldest.Add(rl.window)
+}
+
 // Try checks if it's within the rate limits.
 func (rl *RingLimiter) try(now time.Time) bool {
 	oldestAllowedTime := now.Add(-rl.window)
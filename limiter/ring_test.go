@@ -33,3 +33,74 @@ func TestRingLimiter(t *testing.T) {
 		t.Error("Fourth request should be allowed after waiting 1 second")
 	}
 }
+
+func TestRingLimiter_Resize(t *testing.T) {
+	now := time.Now()
+	rl := NewRingLimiter(3, time.Minute)
+	for i := 0; i < 3; i++ {
+		rl.Accept(now.Add(time.Duration(i) * time.Second))
+	}
+
+	// Growing keeps every request
+	rl.Resize(5, time.Minute)
+	if size, window := rl.LimitDetails(); size != 5 || window != time.Minute {
+		t.Fatalf("Expected size 5 and window 1m, got %d and %v", size, window)
+	}
+	if !rl.TryAccept(now.Add(3*time.Second)) || !rl.TryAccept(now.Add(4*time.Second)) {
+		t.Fatal("Requests up to the new size should be allowed")
+	}
+	if rl.TryAccept(now.Add(5 * time.Second)) {
+		t.Fatal("Requests recorded before the resize should count towards the new size")
+	}
+
+	// Shrinking keeps the most recent requests, the oldest one kept was at 3s
+	rl.Resize(2, 10*time.Second)
+	if rl.Try(now.Add(12 * time.Second)) {
+		t.Error("Most recent requests should be kept")
+	}
+	if !rl.Try(now.Add(13*time.Second + time.Millisecond)) {
+		t.Error("Oldest requests should be dropped when shrinking")
+	}
+}
+
+func TestRingLimiter_Usage(t *testing.T) {
+	now := time.Now()
+	rl := NewRingLimiter(3, time.Minute)
+
+	if used, reset := rl.Usage(now); used != 0 || !reset.IsZero() {
+		t.Fatalf("Expected no usage, got %d and %v", used, reset)
+	}
+
+	rl.Accept(now.Add(-2 * time.Minute))
+	rl.Accept(now.Add(-30 * time.Second))
+	rl.Accept(now)
+
+	used, reset := rl.Usage(now)
+	if used != 2 {
+		t.Errorf("Expected the 2 requests in the window, got %d", used)
+	}
+	if want := now.Add(30 * time.Second); !reset.Equal(want) {
+		t.Errorf("Expected the oldest request to leave the window at %v, got %v", want, reset)
+	}
+}
+
+func TestRingLimiter_TryAcceptN(t *testing.T) {
+	now := time.Now()
+	rl := NewRingLimiter(5, time.Minute)
+
+	if rl.TryAcceptN(now, 6) {
+		t.Fatal("Requests over the size should never be allowed")
+	}
+	if !rl.TryAcceptN(now, 3) {
+		t.Fatal("Requests within the limit should be allowed")
+	}
+	if rl.TryAcceptN(now, 3) {
+		t.Fatal("Requests over the remaining limit should be rejected")
+	}
+	if !rl.TryAcceptN(now, 2) {
+		t.Fatal("Requests up to the remaining limit should be allowed")
+	}
+	if !rl.TryAcceptN(now.Add(time.Minute+time.Millisecond), 5) {
+		t.Error("Requests should be allowed once the window passed")
+	}
+}
@@ -0,0 +1,198 @@
+package ratebroker
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// Default log sampling, see WithLogSampling.
+const (
+	defaultLogSamplingFirst  = 10
+	defaultLogSamplingPeriod = time.Minute
+)
+
+// WithLogger sets the logger of the RateBroker, slog.Default() by default.
+// Repetitive warnings and errors are sampled, see WithLogSampling.
+func WithLogger(logger *slog.Logger) Option {
+	return func(rb *RateBroker) {
+		rb.logger = logger
+	}
+}
+
+// WithLogSampling logs only the first warnings and errors with the same message in
+// every period, 10 per minute by default, so that e.g. a broker outage failing every
+// publish does not flood the logs. The first record logged after some were dropped
+// has a "suppressed" attribute with their number. A first of 0 or less logs every record.
+func WithLogSampling(first int, period time.Duration) Option {
+	return func(rb *RateBroker) {
+		rb.logSampling = logSampling{first: first, period: period}
+	}
+}
+
+// WithBrokerLogger sets the logger of the broker, slog.Default() by default.
+// Repetitive warnings and errors are sampled, see WithBrokerLogSampling.
+func WithBrokerLogger(logger *slog.Logger) func(*RedisMessageBroker) {
+	return func(r *RedisMessageBroker) {
+		r.logger = logger
+	}
+}
+
+// WithBrokerLogSampling samples the warnings and errors of the broker, see WithLogSampling.
+func WithBrokerLogSampling(first int, period time.Duration) func(*RedisMessageBroker) {
+	return func(r *RedisMessageBroker) {
+		r.logSampling = logSampling{first: first, period: period}
+	}
+}
+
+// WithSigningLogger sets the logger of the SigningBroker, slog.Default() by default.
+// The warnings about rejected messages are sampled like the ones of the RateBroker, so
+// that a replica publishing with a wrong key does not flood the logs.
+func WithSigningLogger(logger *slog.Logger) func(*SigningBroker) {
+	return func(sb *SigningBroker) {
+		sb.logger = logger
+	}
+}
+
+// logSampling is the number of records with the same message logged per period.
+type logSampling struct {
+	first  int
+	period time.Duration
+}
+
+var defaultLogSampling = logSampling{first: defaultLogSamplingFirst, period: defaultLogSamplingPeriod}
+
+// newLogger returns the logger, slog.Default() at the time of logging if nil, with the
+// sampling applied.
+func (s logSampling) newLogger(logger *slog.Logger) *slog.Logger {
+	if logger == nil {
+		logger = slog.New(defaultHandler{})
+	}
+	if s.first <= 0 || s.period <= 0 {
+		return logger
+	}
+
+	return slog.New(&samplingHandler{
+		next:    logger.Handler(),
+		sampler: &sampler{sampling: s, counters: make(map[sampleKey]*sampleCounter)},
+	})
+}
+
+// samplingHandler is a slog.Handler dropping repetitive warnings and errors.
+type samplingHandler struct {
+	next    slog.Handler
+	sampler *sampler // Shared with the handlers derived by WithAttrs and WithGroup
+}
+
+func (h *samplingHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *samplingHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelWarn {
+		return h.next.Handle(ctx, record)
+	}
+
+	now := record.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+
+	log, suppressed := h.sampler.sample(sampleKey{record.Level, record.Message}, now)
+	if !log {
+		return nil
+	}
+	if suppressed > 0 {
+		record = record.Clone()
+		record.AddAttrs(slog.Uint64("suppressed", suppressed))
+	}
+	return h.next.Handle(ctx, record)
+}
+
+func (h *samplingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &samplingHandler{next: h.next.WithAttrs(attrs), sampler: h.sampler}
+}
+
+func (h *samplingHandler) WithGroup(name string) slog.Handler {
+	return &samplingHandler{next: h.next.WithGroup(name), sampler: h.sampler}
+}
+
+// defaultHandler is a slog.Handler logging to the handler of slog.Default(), resolved on
+// every call so that a later slog.SetDefault is followed. The attributes and groups are
+// applied to the default handler in the order they were added.
+type defaultHandler struct {
+	derive []func(slog.Handler) slog.Handler
+}
+
+func (h defaultHandler) handler() slog.Handler {
+	handler := slog.Default().Handler()
+	for _, derive := range h.derive {
+		handler = derive(handler)
+	}
+	return handler
+}
+
+func (h defaultHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler().Enabled(ctx, level)
+}
+
+func (h defaultHandler) Handle(ctx context.Context, record slog.Record) error {
+	return h.handler().Handle(ctx, record)
+}
+
+func (h defaultHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithAttrs(attrs) })
+}
+
+func (h defaultHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(handler slog.Handler) slog.Handler { return handler.WithGroup(name) })
+}
+
+func (h defaultHandler) with(derive func(slog.Handler) slog.Handler) slog.Handler {
+	return defaultHandler{derive: append(h.derive[:len(h.derive):len(h.derive)], derive)}
+}
+
+// sampler counts the records logged per level and message.
+type sampler struct {
+	sampling logSampling
+	mutex    sync.Mutex
+	counters map[sampleKey]*sampleCounter
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+type sampleCounter struct {
+	start      time.Time // Start of the current period
+	logged     int
+	suppressed uint64
+}
+
+// sample reports whether a record should be logged and how many were dropped since the last one logged.
+func (s *sampler) sample(key sampleKey, now time.Time) (bool, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	counter, ok := s.counters[key]
+	if !ok {
+		counter = &sampleCounter{start: now}
+		s.counters[key] = counter
+	}
+
+	if now.Sub(counter.start) >= s.sampling.period {
+		counter.start, counter.logged = now, 0
+	}
+	if counter.logged >= s.sampling.first {
+		counter.suppressed++
+		return false, 0
+	}
+
+	counter.logged++
+	suppressed := counter.suppressed
+	counter.suppressed = 0
+	return true, suppressed
+}
@@ -0,0 +1,144 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+	"golang.org/x/exp/slog"
+)
+
+// logBuffer is a goroutine safe buffer of JSON log records.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records returns the records logged with the message.
+func (b *logBuffer) records(t *testing.T, message string) []map[string]interface{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(b.buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("Unexpected log line %q: %v", line, err)
+		}
+		if record["msg"] == message {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+func TestRateBroker_LogSampling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var logs logBuffer
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithWindow(time.Second),
+		ratebroker.WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+		ratebroker.WithLogSampling(2, 50*time.Millisecond),
+	)
+	rb.Start(ctx)
+	waitForConsumers(t, broker, 1)
+
+	publishStale := func(n int) {
+		for i := 0; i < n; i++ {
+			broker.Publish(ctx, ratebroker.Message{
+				BrokerID:  "other",
+				Event:     ratebroker.RequestAccepted,
+				Timestamp: time.Now().Add(-time.Hour),
+				Key:       "user1",
+			})
+		}
+	}
+
+	publishStale(5)
+	if records := logs.records(t, "message too old, ignoring"); len(records) != 2 {
+		t.Fatalf("Expected the first 2 warnings to be logged, got %d", len(records))
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	publishStale(1)
+
+	records := logs.records(t, "message too old, ignoring")
+	if len(records) != 3 {
+		t.Fatalf("Expected a warning to be logged in the next period, got %d", len(records))
+	}
+	if suppressed := records[2]["suppressed"]; suppressed != float64(3) {
+		t.Errorf("Expected 3 suppressed warnings, got %v", suppressed)
+	}
+}
+
+func TestRateBroker_LogSamplingDisabled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var logs logBuffer
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+		ratebroker.WithLogSampling(0, 0),
+	)
+	rb.Start(ctx)
+	waitForConsumers(t, broker, 1)
+
+	for i := 0; i < 20; i++ {
+		broker.Publish(ctx, ratebroker.Message{BrokerID: "other", Event: "UNKNOWN", Key: "user1"})
+	}
+
+	if records := logs.records(t, "unknown event, ignoring"); len(records) != 20 {
+		t.Errorf("Expected every warning to be logged without sampling, got %d", len(records))
+	}
+}
+
+func TestRateBroker_LogDefaultSetLater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(ratebroker.WithBroker(broker))
+
+	// The default logger is set after the RateBroker is created
+	var logs logBuffer
+	previous := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(previous)
+
+	rb.Start(ctx)
+	waitForConsumers(t, broker, 1)
+
+	broker.Publish(ctx, ratebroker.Message{BrokerID: "other", Event: "UNKNOWN", Key: "user1"})
+
+	if records := logs.records(t, "unknown event, ignoring"); len(records) != 1 {
+		t.Errorf("Expected the warning to be logged by the current default logger, got %d", len(records))
+	}
+}
@@ -0,0 +1,268 @@
+package ratebroker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decisions reported to Metrics.ObserveDecision for every TryAccept.
+const (
+	DecisionAccepted    = "accepted"     // Allowed by the limiter
+	DecisionRejected    = "rejected"     // Rejected by the limiter
+	DecisionBanned      = "banned"       // Rejected because the key is banned
+	DecisionDenied      = "denied"       // Rejected by the deny list
+	DecisionAllowListed = "allow_listed" // Allowed by the allow list without limiting
+	DecisionWouldReject = "would_reject" // Allowed in shadow mode but would have been rejected
+)
+
+// Metrics receives measurements from a RateBroker, see WithMetrics, and from a
+// RedisMessageBroker, see WithBrokerMetrics. Implementations must be safe for
+// concurrent use. PrometheusMetrics is an implementation in the Prometheus format.
+type Metrics interface {
+	// ObserveDecision is called for every TryAccept with one of the Decision constants.
+	ObserveDecision(decision string)
+	// ObservePublish is called for every message the RateBroker publishes to its broker.
+	ObservePublish(duration time.Duration, err error)
+	// ObserveSemaphoreWait is called with the time spent waiting to publish, see WithMaxThreads.
+	ObserveSemaphoreWait(duration time.Duration)
+	// ObserveConsume is called by the RedisMessageBroker for every read from a stream.
+	ObserveConsume(stream string, messages int, err error)
+}
+
+// WithMetrics reports the RateBroker's decisions and publishes to metrics.
+func WithMetrics(metrics Metrics) Option {
+	return func(rb *RateBroker) {
+		rb.metrics = metrics
+	}
+}
+
+// WithBrokerMetrics reports the messages consumed by the broker to metrics.
+func WithBrokerMetrics(metrics Metrics) func(*RedisMessageBroker) {
+	return func(r *RedisMessageBroker) {
+		r.metrics = metrics
+	}
+}
+
+// nopMetrics is the Metrics used when none are configured.
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveDecision(string)              {}
+func (nopMetrics) ObservePublish(time.Duration, error) {}
+func (nopMetrics) ObserveSemaphoreWait(time.Duration)  {}
+func (nopMetrics) ObserveConsume(string, int, error)   {}
+
+// metricsTopKeys is the number of heavy hitters reported by Handler, see WithHeavyHitters.
+const metricsTopKeys = 10
+
+// durationBuckets are the upper bounds, in seconds, of the histogram buckets for durations.
+var durationBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// histogram is a Prometheus histogram of durations.
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(duration time.Duration) {
+	seconds := duration.Seconds()
+	h.count++
+	h.sum += seconds
+
+	if i := sort.SearchFloat64s(durationBuckets, seconds); i < len(durationBuckets) {
+		h.counts[i]++
+	}
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	var cumulative uint64
+	for i, bound := range durationBuckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=%s} %d\n", name, quoteLabel(strconv.FormatFloat(bound, 'g', -1, 64)), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+}
+
+// PrometheusMetrics is a Metrics implementation that serves the measurements in the
+// Prometheus text format from Handler, along with gauges read from the RateBroker.
+// The same PrometheusMetrics can be passed to WithMetrics and WithBrokerMetrics.
+type PrometheusMetrics struct {
+	mutex            sync.Mutex
+	decisions        map[string]uint64
+	publishFailures  uint64
+	publishDuration  *histogram
+	semaphoreWait    *histogram
+	consumedMessages map[string]uint64
+	consumeErrors    map[string]uint64
+}
+
+// NewPrometheusMetrics creates an empty PrometheusMetrics.
+func NewPrometheusMetrics() *PrometheusMetrics {
+	return &PrometheusMetrics{
+		decisions:        make(map[string]uint64),
+		publishDuration:  newHistogram(),
+		semaphoreWait:    newHistogram(),
+		consumedMessages: make(map[string]uint64),
+		consumeErrors:    make(map[string]uint64),
+	}
+}
+
+// ObserveDecision counts the decision.
+func (m *PrometheusMetrics) ObserveDecision(decision string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.decisions[decision]++
+}
+
+// ObservePublish records the publish latency and counts failures.
+func (m *PrometheusMetrics) ObservePublish(duration time.Duration, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.publishDuration.observe(duration)
+	if err != nil {
+		m.publishFailures++
+	}
+}
+
+// ObserveSemaphoreWait records the time spent waiting to publish.
+func (m *PrometheusMetrics) ObserveSemaphoreWait(duration time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.semaphoreWait.observe(duration)
+}
+
+// ObserveConsume counts the messages consumed and the read errors per stream.
+func (m *PrometheusMetrics) ObserveConsume(stream string, messages int, err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.consumedMessages[stream] += uint64(messages)
+	if err != nil {
+		m.consumeErrors[stream]++
+	}
+}
+
+// Handler serves the metrics in the Prometheus text format. When rb is not nil the
+// number of tracked keys, the consumer's health and its lag are reported as well, along
+// with the 10 keys with the most accepted and rejected requests if WithHeavyHitters is used.
+func (m *PrometheusMetrics) Handler(rb *RateBroker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		var out strings.Builder
+		m.write(&out)
+		if rb != nil {
+			writeRateBrokerMetrics(&out, r, rb)
+		}
+
+		io.WriteString(w, out.String())
+	})
+}
+
+func (m *PrometheusMetrics) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	writeHeader(w, "ratebroker_requests_total", "counter", "Requests checked by TryAccept by decision.")
+	for _, decision := range sortedKeys(m.decisions) {
+		fmt.Fprintf(w, "ratebroker_requests_total{decision=%s} %d\n", quoteLabel(decision), m.decisions[decision])
+	}
+
+	writeHeader(w, "ratebroker_publish_duration_seconds", "histogram", "Time taken to publish a message to the broker.")
+	m.publishDuration.write(w, "ratebroker_publish_duration_seconds")
+
+	writeHeader(w, "ratebroker_publish_failures_total", "counter", "Messages that failed to publish to the broker.")
+	fmt.Fprintf(w, "ratebroker_publish_failures_total %d\n", m.publishFailures)
+
+	writeHeader(w, "ratebroker_semaphore_wait_seconds", "histogram", "Time spent waiting for a publish slot.")
+	m.semaphoreWait.write(w, "ratebroker_semaphore_wait_seconds")
+
+	writeHeader(w, "ratebroker_consumed_messages_total", "counter", "Messages read from the broker by stream.")
+	for _, stream := range sortedKeys(m.consumedMessages) {
+		fmt.Fprintf(w, "ratebroker_consumed_messages_total{stream=%s} %d\n", quoteLabel(stream), m.consumedMessages[stream])
+	}
+
+	writeHeader(w, "ratebroker_consume_errors_total", "counter", "Errors reading from the broker by stream.")
+	for _, stream := range sortedKeys(m.consumeErrors) {
+		fmt.Fprintf(w, "ratebroker_consume_errors_total{stream=%s} %d\n", quoteLabel(stream), m.consumeErrors[stream])
+	}
+}
+
+// writeRateBrokerMetrics writes the gauges read from the RateBroker.
+func writeRateBrokerMetrics(w io.Writer, r *http.Request, rb *RateBroker) {
+	writeHeader(w, "ratebroker_tracked_keys", "gauge", "Keys tracked by the RateBroker.")
+	fmt.Fprintf(w, "ratebroker_tracked_keys %d\n", rb.TrackedKeys())
+
+	health := rb.ConsumerHealth()
+	writeHeader(w, "ratebroker_ready", "gauge", "Whether the RateBroker is ready to serve traffic.")
+	fmt.Fprintf(w, "ratebroker_ready %d\n", boolToInt(health.Ready))
+	writeHeader(w, "ratebroker_consumer_restarts_total", "counter", "Times the consumer was restarted after an error.")
+	fmt.Fprintf(w, "ratebroker_consumer_restarts_total %d\n", health.Restarts)
+	writeHeader(w, "ratebroker_consumer_malformed_total", "counter", "Malformed messages skipped by the consumer.")
+	fmt.Fprintf(w, "ratebroker_consumer_malformed_total %d\n", health.Stats.Malformed)
+	writeHeader(w, "ratebroker_consumer_rejected_total", "counter", "Messages rejected by the SigningBroker.")
+	fmt.Fprintf(w, "ratebroker_consumer_rejected_total %d\n", health.Stats.Rejected)
+
+	if rb.heavyHitters != nil {
+		top := rb.HeavyHitters(metricsTopKeys)
+		writeHeader(w, "ratebroker_top_key_requests", "gauge", "Estimated requests of the keys with the most requests by decision.")
+		for _, hitter := range top.Accepted {
+			fmt.Fprintf(w, "ratebroker_top_key_requests{decision=\"accepted\",key=%s} %d\n", quoteLabel(hitter.Key), hitter.Count)
+		}
+		for _, hitter := range top.Rejected {
+			fmt.Fprintf(w, "ratebroker_top_key_requests{decision=\"rejected\",key=%s} %d\n", quoteLabel(hitter.Key), hitter.Count)
+		}
+	}
+
+	lag, err := rb.ConsumerLag(r.Context())
+	if err != nil {
+		return
+	}
+	writeHeader(w, "ratebroker_consumer_lag_messages", "gauge", "Messages published by other replicas not consumed yet.")
+	fmt.Fprintf(w, "ratebroker_consumer_lag_messages %d\n", lag.Messages)
+	writeHeader(w, "ratebroker_consumer_lag_seconds", "gauge", "Age of the oldest message not consumed yet.")
+	fmt.Fprintf(w, "ratebroker_consumer_lag_seconds %g\n", lag.Latency.Seconds())
+}
+
+// labelEscaper escapes the characters the Prometheus text format requires escaping in label values.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quoteLabel quotes a label value for the Prometheus text format. Unlike %q it only
+// escapes backslashes, double quotes and line feeds, the format does not accept other
+// escapes, and replaces invalid UTF-8 as the format must be UTF-8.
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(strings.ToValidUTF8(value, "\uFFFD")) + `"`
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
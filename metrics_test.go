@@ -0,0 +1,98 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+func TestPrometheusMetrics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	metrics := ratebroker.NewPrometheusMetrics()
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithMaxRequests(2),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithMaxThreads(4),
+		ratebroker.WithMetrics(metrics),
+	)
+	rb.Start(ctx)
+	waitForConsumers(t, broker, 1)
+
+	for i := 0; i < 3; i++ {
+		rb.TryAccept(ctx, "user1")
+	}
+	rb.TryAccept(ctx, "user2")
+	if err := rb.AddToDenyList(ctx, "user3"); err != nil {
+		t.Fatalf("Unexpected error adding to the deny list: %v", err)
+	}
+	rb.TryAccept(ctx, "user3")
+	metrics.ObserveConsume("ratebroker", 5, nil)
+	time.Sleep(20 * time.Millisecond)
+
+	rec := httptest.NewRecorder()
+	metrics.Handler(rb).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Expected the Prometheus text format, got %q", contentType)
+	}
+
+	for _, expected := range []string{
+		`ratebroker_requests_total{decision="accepted"} 3`,
+		`ratebroker_requests_total{decision="rejected"} 1`,
+		`ratebroker_requests_total{decision="denied"} 1`,
+		"# TYPE ratebroker_publish_duration_seconds histogram",
+		// Three accepted requests and the deny list entry
+		`ratebroker_publish_duration_seconds_bucket{le="+Inf"} 4`,
+		"ratebroker_publish_failures_total 0",
+		"ratebroker_semaphore_wait_seconds_count 3",
+		`ratebroker_consumed_messages_total{stream="ratebroker"} 5`,
+		"ratebroker_tracked_keys 2",
+		"ratebroker_ready 1",
+	} {
+		if !strings.Contains(body, expected+"\n") {
+			t.Errorf("Expected %q in the metrics:\n%s", expected, body)
+		}
+	}
+}
+
+func TestRateBroker_TrackedKeys(t *testing.T) {
+	ctx := context.Background()
+	rb := ratebroker.NewRateBroker()
+
+	for _, key := range []string{"user1", "user2", "user1"} {
+		rb.TryAccept(ctx, key)
+	}
+	if keys := rb.TrackedKeys(); keys != 2 {
+		t.Errorf("Expected 2 tracked keys, got %d", keys)
+	}
+
+	// Replacing the limiter does not change the count
+	if err := rb.UpdatePolicy(ctx, "user1", 5, time.Minute); err != nil {
+		t.Fatalf("Unexpected error updating policy: %v", err)
+	}
+	rb.TryAccept(ctx, "user1")
+	if keys := rb.TrackedKeys(); keys != 2 {
+		t.Errorf("Expected 2 tracked keys after a policy update, got %d", keys)
+	}
+
+	if err := rb.ResetKey(ctx, "user2"); err != nil {
+		t.Fatalf("Unexpected error resetting key: %v", err)
+	}
+	if keys := rb.TrackedKeys(); keys != 1 {
+		t.Errorf("Expected 1 tracked key after a reset, got %d", keys)
+	}
+}
@@ -2,7 +2,9 @@ package ratebroker
 
 import (
 	"fmt"
+	"math"
 	"net/http"
+	"time"
 )
 
 // HttpMiddleware creates a new middleware function for rate limiting.
@@ -18,11 +20,20 @@ func HttpMiddleware(rb *RateBroker, keyGetter func(r *http.Request) string) func
 				// Apply rate limit headers or other response properties here
 				w.Header().Add("X-Rate-Limit-Limit", fmt.Sprintf("%v", details.MaxRequests))
 				w.Header().Add("X-Rate-Limit-Duration", fmt.Sprintf("%v", details.Window))
+				if !details.BannedUntil.IsZero() {
+					retryAfter := math.Ceil(time.Until(details.BannedUntil).Seconds())
+					w.Header().Add("Retry-After", fmt.Sprintf("%.0f", retryAfter))
+				}
 				w.WriteHeader(http.StatusTooManyRequests)
 				// You might want to write a response message indicating the rate limit has been hit
 				return
 			}
 
+			// In shadow mode mark the requests that would have been rate-limited
+			if details.WouldReject {
+				w.Header().Add("X-Rate-Limit-Would-Limit", "true")
+			}
+
 			// Proceed to the next handler if not rate-limited
 			next.ServeHTTP(w, r)
 		})
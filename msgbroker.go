@@ -2,27 +2,61 @@ package ratebroker
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/jpillora/backoff"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
+	"golang.org/x/sync/errgroup"
 )
 
 const (
 	// RequestAccepted is the event type for a request that was accepted.
 	RequestAccepted = "REQUEST_ACCEPTED"
+	// KeyReset is the event type for a key whose limiter was reset.
+	KeyReset = "KEY_RESET"
+	// KeyBanned is the event type for a key that was banned for Duration from Timestamp.
+	KeyBanned = "KEY_BANNED"
+	// KeyUnbanned is the event type for a key whose ban was lifted.
+	KeyUnbanned = "KEY_UNBANNED"
+	// PolicyUpdated is the event type for a key whose limit changed to MaxRequests per Window.
+	PolicyUpdated = "POLICY_UPDATED"
+	// LimitsUpdated is the event type for the default limit changing to MaxRequests per Window.
+	LimitsUpdated = "LIMITS_UPDATED"
+	// AllowListAdded is the event type for an entry, held in Key, added to the allow list.
+	AllowListAdded = "ALLOW_LIST_ADDED"
+	// AllowListRemoved is the event type for an entry, held in Key, removed from the allow list.
+	AllowListRemoved = "ALLOW_LIST_REMOVED"
+	// DenyListAdded is the event type for an entry, held in Key, added to the deny list.
+	DenyListAdded = "DENY_LIST_ADDED"
+	// DenyListRemoved is the event type for an entry, held in Key, removed from the deny list.
+	DenyListRemoved = "DENY_LIST_REMOVED"
 )
 
 // Message represents the structure of the data that will be sent through the broker.
 type Message struct {
-	BrokerID  string    `json:"broker_id"` // The ID of the broker
-	Event     string    `json:"event"`     // Type of event, e.g., "request_accepted"
-	Timestamp time.Time `json:"timestamp"` // When the event occurred
-	Key       string    `json:"key"`       // The key of the request, e.g., IP, UserID, etc.
+	ID        string    `json:"id,omitempty"`        // Unique ID of the event, used to ignore duplicates
+	BrokerID  string    `json:"broker_id"`           // The ID of the broker
+	Event     string    `json:"event"`               // Type of event, e.g., "request_accepted"
+	Timestamp time.Time `json:"timestamp"`           // When the event occurred
+	Key       string    `json:"key"`                 // The key of the request, e.g., IP, UserID, etc.
+	Signature string    `json:"signature,omitempty"` // Set by the SigningBroker, see NewSigningBroker
+
+	MaxRequests int           `json:"max_requests,omitempty"` // The new limit of a PolicyUpdated event
+	Window      time.Duration `json:"window,omitempty"`       // The new window of a PolicyUpdated event
+	Duration    time.Duration `json:"duration,omitempty"`     // How long a KeyBanned event bans the key for
+	Count       int           `json:"count,omitempty"`        // The number of requests of a RequestAccepted event, 1 when 0
+
+	TraceParent string `json:"traceparent,omitempty"` // W3C trace context of the publishing span, see WithTracerProvider
 }
 
 // MessageBroker is an interface that defines the methods that a broker must implement.
@@ -33,19 +67,115 @@ type MessageBroker interface {
 	Consume(ctx context.Context, handlerFunc func(Message)) error
 }
 
+// ReadinessNotifier is an optional interface a MessageBroker can implement to signal
+// that Consume has caught up with the history it replays on startup.
+//
+// The RateBroker uses it to delay reporting itself as ready until its limiters
+// have been warmed up with recent requests from the other replicas.
+type ReadinessNotifier interface {
+	// Ready returns a channel that is closed once the initial history has been replayed.
+	Ready() <-chan struct{}
+}
+
+// ConsumerStats are counters a MessageBroker can report about its consumer.
+type ConsumerStats struct {
+	Malformed    uint64 // Messages that could not be decoded and were skipped
+	DeadLettered uint64 // Malformed messages copied to the dead letter stream
+	ReadErrors   uint64 // Failed reads from the broker that were retried
+	Rejected     uint64 // Messages dropped because their signature could not be verified
+}
+
+// StatsReporter is an optional interface a MessageBroker can implement to report
+// counters about its consumer, they are included in the RateBroker's ConsumerHealth.
+type StatsReporter interface {
+	ConsumerStats() ConsumerStats
+}
+
+// Lag describes how far a consumer is behind the newest message in the broker.
+type Lag struct {
+	Messages int64         // Number of messages published but not yet consumed
+	Latency  time.Duration // Time between the last consumed message and the newest message
+}
+
+// LagReporter is an optional interface a MessageBroker can implement to report
+// how far its consumer is behind the messages published by the other replicas.
+type LagReporter interface {
+	Lag(ctx context.Context) (Lag, error)
+}
+
+// Field names and version of the Redis stream entry encoding of a Message.
+//
+// Every field is stored as a string, the timestamp as Unix nanoseconds in UTC.
+// The ID, signature, trace context, count and the fields of control events are optional and only stored when set.
+const (
+	wireVersion        = "1"
+	fieldVersion       = "v"
+	fieldID            = "id"
+	fieldBrokerID      = "broker_id"
+	fieldEvent         = "event"
+	fieldTimestamp     = "ts"
+	fieldKey           = "key"
+	fieldSignature     = "sig"
+	fieldMaxRequests   = "max"
+	fieldWindow        = "window" // Nanoseconds
+	fieldDuration      = "dur"    // Nanoseconds
+	fieldCount         = "n"
+	fieldTraceParent   = "tp" // W3C traceparent
+	fieldPayload       = "d"  // Holds the whole message when a Codec is used
+	zeroTimestampValue = "0"
+)
+
+// readCount is the number of messages read from the stream per call.
+const readCount = 100
+
+// lagCountLimit caps the number of messages counted when computing the lag,
+// a consumer further behind than this reports lagCountLimit messages.
+const lagCountLimit = 1000
+
 // RedisMessageBroker is an implementation of the Broker interface
 // that uses Redis as the message broker.
+//
+// The client can be any redis.UniversalClient, so a single node, Sentinel
+// (redis.NewFailoverClient) or Cluster (redis.NewClusterClient) setup can be used.
 type RedisMessageBroker struct {
 	stream string
-	client *redis.Client
+	shards int
+	client redis.UniversalClient
 
 	//name time duration for pull older messages on startup
 	initialLoadOffset time.Duration
 
+	// consumer is the consumer group and consumer name, empty unless WithConsumerGroup is used
+	consumer string
+
+	// deadLetterStream receives malformed messages, empty unless WithDeadLetterStream is used
+	deadLetterStream string
+
+	// codec encodes messages into a single field, nil uses one field per Message field
+	codec Codec
+
 	backoff *backoff.Backoff
+
+	ready       chan struct{}
+	readyOnce   sync.Once
+	readyShards map[string]struct{} // The streams that replayed their history, see markShardReady
+
+	// positions holds the ID of the last consumed message per stream and is used to compute the lag
+	positions map[string]string
+	mutex     sync.Mutex
+
+	malformed    atomic.Uint64
+	deadLettered atomic.Uint64
+	readErrors   atomic.Uint64
+
+	metrics Metrics
+	tracer  trace.Tracer
+
+	logger      *slog.Logger
+	logSampling logSampling
 }
 
-func NewRedisMessageBroker(rdb *redis.Client, opts ...func(*RedisMessageBroker)) *RedisMessageBroker {
+func NewRedisMessageBroker(rdb redis.UniversalClient, opts ...func(*RedisMessageBroker)) *RedisMessageBroker {
 	// Create an exponential backoff configuration
 	b := backoff.Backoff{
 		//These are the defaults
@@ -56,15 +186,23 @@ func NewRedisMessageBroker(rdb *redis.Client, opts ...func(*RedisMessageBroker))
 	}
 
 	rb := &RedisMessageBroker{
-		client:  rdb,
-		stream:  "ratebroker",
-		backoff: &b,
+		client:      rdb,
+		stream:      "ratebroker",
+		shards:      1,
+		backoff:     &b,
+		ready:       make(chan struct{}),
+		readyShards: make(map[string]struct{}),
+		positions:   make(map[string]string),
+		metrics:     nopMetrics{},
+		tracer:      noopTracer,
+		logSampling: defaultLogSampling,
 	}
 
 	// Apply all provided options
 	for _, opt := range opts {
 		opt(rb)
 	}
+	rb.logger = rb.logSampling.newLogger(rb.logger)
 
 	return rb
 }
@@ -78,6 +216,20 @@ func WithStream(stream string) func(*RedisMessageBroker) {
 	}
 }
 
+// WithShards spreads the messages over n streams by hashing Message.Key, so a
+// single stream does not become a hotspot. In a Redis Cluster each stream can
+// live on a different node. The streams are named "<stream>:<shard>", all
+// replicas must use the same number of shards.
+// default: 1, which uses the stream name as is
+func WithShards(n int) func(*RedisMessageBroker) {
+	return func(rb *RedisMessageBroker) {
+		if n < 1 {
+			n = 1
+		}
+		rb.shards = n
+	}
+}
+
 // WithInitLoadOffset is a time duration that will allow
 // the pulling of older messages on startup from the topic.
 // This would be used for not losing client request history on
@@ -88,26 +240,102 @@ func WithInitLoadOffset(offset time.Duration) func(*RedisMessageBroker) {
 	}
 }
 
+// WithConsumerGroup consumes the stream through a Redis consumer group named
+// after the supplied consumer ID instead of a plain XREAD.
+//
+// Every replica needs to see every message, so each replica gets its own group and
+// the ID should be stable and unique per pod/replica, e.g. the ID passed to the
+// RateBroker with WithID. Consumed messages are acknowledged, which lets a replica
+// that restarts with the same ID resume from where it left off. The initial load
+// offset is only used when the group is created.
+func WithConsumerGroup(consumerID string) func(*RedisMessageBroker) {
+	return func(rb *RedisMessageBroker) {
+		rb.consumer = consumerID
+	}
+}
+
+// WithDeadLetterStream copies messages that cannot be decoded to the supplied
+// stream along with the decoding error, so they can be inspected later.
+// Malformed messages are always skipped and counted, with or without this option.
+func WithDeadLetterStream(stream string) func(*RedisMessageBroker) {
+	return func(rb *RedisMessageBroker) {
+		rb.deadLetterStream = stream
+	}
+}
+
+// WithCodec stores each message as a single field encoded by the codec, e.g. a
+// BinaryCodec to reduce the size of the stream. Without a codec every field of the
+// Message is stored as a separate field of the stream entry.
+func WithCodec(codec Codec) func(*RedisMessageBroker) {
+	return func(rb *RedisMessageBroker) {
+		rb.codec = codec
+	}
+}
+
 // Publish publishes a message to a Redis stream
 func (r *RedisMessageBroker) Publish(ctx context.Context, message Message) error {
-	values := map[string]interface{}{
-		"broker_id": message.BrokerID,
-		"event":     message.Event,
-		"timestamp": message.Timestamp,
-		"key":       message.Key,
+	values, err := r.encode(message)
+	if err != nil {
+		return err
 	}
 
 	return r.client.XAdd(ctx, &redis.XAddArgs{
-		Stream: r.stream,
+		Stream: r.streamForKey(message.Key),
 		Values: values,
 	}).Err()
 }
 
-// Consume listens to messages on a Redis stream and processes them with handlerFunc
+// Ready returns a channel that is closed once Consume has replayed the messages
+// within the initial load offset. Without an initial load offset there is no
+// history to replay and the channel is closed as soon as Consume starts.
+//
+// In consumer group mode any messages published since the group last
+// acknowledged a message are replayed before the channel is closed.
+func (r *RedisMessageBroker) Ready() <-chan struct{} {
+	return r.ready
+}
+
+// Consume listens to messages on the Redis streams and processes them with handlerFunc.
+// Each shard is consumed concurrently, an error consuming one of them stops all of them.
+//
+// Read and acknowledgement errors are retried with backoff and malformed messages are
+// skipped, so Consume only returns when the context is done or the consumer group
+// cannot be created.
 func (r *RedisMessageBroker) Consume(ctx context.Context, handlerFunc func(Message)) error {
+	g, ctx := errgroup.WithContext(ctx)
+
+	for _, stream := range r.streams() {
+		stream := stream
+		g.Go(func() error {
+			return r.consumeStream(ctx, stream, handlerFunc)
+		})
+	}
+
+	return g.Wait()
+}
+
+// consumeStream listens to messages on a single Redis stream and processes them with handlerFunc
+func (r *RedisMessageBroker) consumeStream(ctx context.Context, stream string, handlerFunc func(Message)) error {
+	cursor := r.loadInitialMessageID(ctx, stream)
+
+	if r.consumer != "" {
+		if err := r.createGroup(ctx, stream, cursor); err != nil {
+			return err
+		}
+		// Start with the messages delivered to this consumer but never acknowledged
+		cursor = "0"
+	}
+
+	// While replaying we read without blocking so that an empty or short read
+	// tells us we have caught up with the stream.
+	replaying := r.initialLoadOffset > 0 || r.consumer != ""
+	if !replaying {
+		r.markShardReady(stream)
+	}
 
-	// Format it as needed for your message fetching system. Here it's formatted as Unix time, but you might need a different format.
-	lastMessageID := r.loadInitialMessageID()
+	// Each stream backs off independently
+	retry := *r.backoff
+	retry.Reset()
 
 	for {
 		// Check the context before a new loop iteration starts
@@ -115,58 +343,612 @@ func (r *RedisMessageBroker) Consume(ctx context.Context, handlerFunc func(Messa
 			return ctx.Err() // Return the actual error that caused the context cancellation
 		}
 
+		block := time.Duration(0)
+		if replaying {
+			block = -1 // a negative duration omits BLOCK from the XREAD call
+		}
+
 		// Read messages from the stream.
-		// 'Count' can be adjusted based on how many messages we want to process per iteration.
-		messages, err := r.client.XRead(ctx, &redis.XReadArgs{
-			Streams: []string{r.stream, lastMessageID},
-			Count:   100, // Define how many messages you want to retrieve at once
-			Block:   0,
-		}).Result()
+		messages, err := r.read(ctx, stream, cursor, block)
+
+		// redis.Nil means there was nothing left to read
+		if err != nil && !errors.Is(err, redis.Nil) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 
-		if err != nil {
 			// log and implement a retry with backoff mechanism
-			slog.Error("Error reading messages from stream", slog.Any("error", err))
-			time.Sleep(r.backoff.Duration())
+			r.readErrors.Add(1)
+			r.metrics.ObserveConsume(stream, 0, err)
+			r.logger.Error("Error reading messages from stream", slog.Any("error", err))
+
+			select {
+			case <-time.After(retry.Duration()):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			continue
 		}
+		retry.Reset()
 
-		// setup a wait group to wait for all messages to be processed
-		// before moving on to the next iteration of x-100 routines
-		var wg sync.WaitGroup
-		// Process messages if any.
-		for _, message := range messages {
-			for _, xMessage := range message.Messages {
-				bstr, _ := json.Marshal(xMessage.Values)
+		lastMessageID, ids := r.process(ctx, stream, messages, handlerFunc)
+		read := len(ids)
+		r.metrics.ObserveConsume(stream, read, nil)
 
-				var msg Message
-				// Deserialize the message
-				if err := json.Unmarshal(bstr, &msg); err != nil {
-					return err // Handle deserialization error
-				}
+		if r.consumer != "" && read > 0 {
+			if err := r.ack(ctx, stream, ids, &retry); err != nil {
+				return err
+			}
+		}
+
+		if r.consumer != "" && cursor != ">" {
+			// Pending messages are read after the ones already handled, so that none is
+			// handled twice, and are all handled once none are returned
+			if read == 0 {
+				cursor = ">"
+			} else {
+				cursor = lastMessageID
+			}
+			continue
+		}
+
+		if r.consumer == "" && read > 0 {
+			cursor = lastMessageID
+		}
+
+		if replaying && read < readCount {
+			replaying = false
+			r.markShardReady(stream)
+		}
+	}
+}
+
+// Lag reports how far the consumer is behind the newest messages on the streams.
+// The messages are summed over all shards and capped at 1000 per shard, the
+// latency is that of the shard furthest behind.
+func (r *RedisMessageBroker) Lag(ctx context.Context) (Lag, error) {
+	var total Lag
+
+	for _, stream := range r.streams() {
+		lag, err := r.streamLag(ctx, stream)
+		if err != nil {
+			return Lag{}, err
+		}
+
+		total.Messages += lag.Messages
+		if lag.Latency > total.Latency {
+			total.Latency = lag.Latency
+		}
+	}
+
+	return total, nil
+}
+
+// streamLag reports how far the consumer is behind the newest message on a single stream.
+func (r *RedisMessageBroker) streamLag(ctx context.Context, stream string) (Lag, error) {
+	position := r.getPosition(stream)
+	if position == "" {
+		return Lag{}, nil
+	}
+
+	latest, err := r.client.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+	if err != nil {
+		return Lag{}, err
+	}
+
+	if len(latest) == 0 || !streamIDAfter(latest[0].ID, position) {
+		return Lag{}, nil
+	}
+
+	behind, err := r.client.XRangeN(ctx, stream, nextStreamID(position), "+", lagCountLimit).Result()
+	if err != nil {
+		return Lag{}, err
+	}
+
+	latestMs, _ := parseStreamID(latest[0].ID)
+	positionMs, _ := parseStreamID(position)
+
+	return Lag{
+		Messages: int64(len(behind)),
+		Latency:  time.Duration(latestMs-positionMs) * time.Millisecond,
+	}, nil
+}
+
+// ConsumerStats reports the number of malformed messages and read errors seen by Consume.
+func (r *RedisMessageBroker) ConsumerStats() ConsumerStats {
+	return ConsumerStats{
+		Malformed:    r.malformed.Load(),
+		DeadLettered: r.deadLettered.Load(),
+		ReadErrors:   r.readErrors.Load(),
+	}
+}
+
+// read reads the next batch of messages after cursor, a negative block does not block.
+func (r *RedisMessageBroker) read(ctx context.Context, stream, cursor string, block time.Duration) ([]redis.XStream, error) {
+	if r.consumer != "" {
+		return r.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    r.consumer,
+			Consumer: r.consumer,
+			Streams:  []string{stream, cursor},
+			Count:    readCount,
+			Block:    block,
+		}).Result()
+	}
+
+	return r.client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{stream, cursor},
+		Count:   readCount, // Define how many messages you want to retrieve at once
+		Block:   block,
+	}).Result()
+}
+
+// process hands the messages to handlerFunc and returns the ID of the last message and the IDs processed.
+// Malformed messages are skipped but still counted as processed, so that they are acknowledged.
+func (r *RedisMessageBroker) process(ctx context.Context, stream string, messages []redis.XStream, handlerFunc func(Message)) (string, []string) {
+	var lastMessageID string
+	var ids []string
+	var decoded []Message
+
+	for _, message := range messages {
+		for _, xMessage := range message.Messages {
+			// Update lastMessageID to acknowledge processing.
+			lastMessageID = xMessage.ID
+			ids = append(ids, xMessage.ID)
+
+			// Deserialize the message
+			msg, err := r.decode(xMessage.Values)
+			if err != nil {
+				r.skipMalformed(ctx, stream, xMessage, err)
+				continue
+			}
+			decoded = append(decoded, msg)
+		}
+	}
+
+	if len(ids) == 0 {
+		return "", nil
+	}
+
+	span := r.startConsumeSpan(ctx, stream, decoded)
+
+	// Messages for the same key are handled in stream order, so that e.g. a ban followed
+	// by an unban or a reset between accepted requests apply in the order they were
+	// published, and messages for different keys concurrently
+	byKey := make(map[string][]Message)
+	for _, msg := range decoded {
+		byKey[msg.Key] = append(byKey[msg.Key], msg)
+	}
+
+	// setup a wait group to wait for all messages to be processed
+	// before moving on to the next iteration of x-100 routines
+	var wg sync.WaitGroup
+	for _, msgs := range byKey {
+		wg.Add(1)
+		go func(msgs []Message) {
+			defer wg.Done()
+			for _, msg := range msgs {
+				handlerFunc(msg)
+			}
+		}(msgs)
+	}
+	wg.Wait()
+	span.End()
+
+	r.setPosition(stream, lastMessageID)
+	return lastMessageID, ids
+}
+
+// ack acknowledges the messages handled by the consumer group, retrying with backoff
+// until it succeeds or the context is done. Unacknowledged messages would be handed to
+// the handler again when the consumer restarts.
+func (r *RedisMessageBroker) ack(ctx context.Context, stream string, ids []string, retry *backoff.Backoff) error {
+	for {
+		err := r.client.XAck(ctx, stream, r.consumer, ids...).Err()
+		if err == nil {
+			retry.Reset()
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		r.logger.Error("error acknowledging messages", slog.Any("error", err.Error()))
+		select {
+		case <-time.After(retry.Duration()):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// startConsumeSpan starts the span of a batch of messages, linked to the spans that published them.
+func (r *RedisMessageBroker) startConsumeSpan(ctx context.Context, stream string, messages []Message) trace.Span {
+	var links []trace.Link
+	for _, msg := range messages {
+		if spanContext := extractTraceParent(msg.TraceParent); spanContext.IsValid() {
+			links = append(links, trace.Link{SpanContext: spanContext})
+		}
+	}
+
+	_, span := r.tracer.Start(ctx, "ratebroker.Consume",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithLinks(links...),
+		trace.WithAttributes(
+			attribute.String("ratebroker.stream", stream),
+			attribute.Int("ratebroker.messages", len(messages)),
+		),
+	)
+	return span
+}
+
+// skipMalformed counts a message that could not be decoded and copies it to the dead letter stream if configured.
+func (r *RedisMessageBroker) skipMalformed(ctx context.Context, stream string, xMessage redis.XMessage, err error) {
+	r.malformed.Add(1)
+	r.logger.Warn("skipping malformed message",
+		slog.String("stream", stream),
+		slog.String("id", xMessage.ID),
+		slog.Any("error", err.Error()),
+	)
+
+	if r.deadLetterStream == "" {
+		return
+	}
+
+	values := make(map[string]interface{}, len(xMessage.Values)+3)
+	for field, value := range xMessage.Values {
+		values[field] = value
+	}
+	values["dead_letter_stream"] = stream
+	values["dead_letter_id"] = xMessage.ID
+	values["dead_letter_error"] = err.Error()
+
+	if err := r.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.deadLetterStream,
+		Values: values,
+	}).Err(); err != nil {
+		r.logger.Error("error publishing to dead letter stream", slog.Any("error", err.Error()))
+		return
+	}
+	r.deadLettered.Add(1)
+}
+
+// createGroup creates the consumer group starting at startID if it does not exist yet.
+func (r *RedisMessageBroker) createGroup(ctx context.Context, stream, startID string) error {
+	err := r.client.XGroupCreateMkStream(ctx, stream, r.consumer, startID).Err()
+	if err == nil {
+		return nil
+	}
+
+	if !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return fmt.Errorf("creating consumer group: %w", err)
+	}
+
+	// The group already exists, resume from its last delivered message
+	groups, err := r.xInfoGroups(ctx, stream)
+	if err != nil {
+		return fmt.Errorf("reading consumer group info: %w", err)
+	}
+
+	for _, group := range groups {
+		if group.Name == r.consumer {
+			r.setPosition(stream, group.LastDeliveredID)
+		}
+	}
+
+	return nil
+}
+
+// xInfoGroups returns the consumer groups of the stream. go-redis v8 only parses the
+// XINFO GROUPS reply of Redis before 7.0, which added fields to it, so the reply of
+// newer versions is parsed here.
+func (r *RedisMessageBroker) xInfoGroups(ctx context.Context, stream string) ([]redis.XInfoGroup, error) {
+	groups, err := r.client.XInfoGroups(ctx, stream).Result()
+	if err == nil || !strings.Contains(err.Error(), "elements in XINFO GROUPS reply") {
+		return groups, err
+	}
+
+	replies, err := r.client.Do(ctx, "XINFO", "GROUPS", stream).Slice()
+	if err != nil {
+		return nil, err
+	}
+
+	groups = make([]redis.XInfoGroup, 0, len(replies))
+	for _, reply := range replies {
+		fields, ok := reply.([]interface{})
+		if !ok || len(fields)%2 != 0 {
+			return nil, fmt.Errorf("unexpected XINFO GROUPS reply %v", reply)
+		}
 
-				// Call the handler function to process the message
-				wg.Add(1)
-				go func() {
-					defer wg.Done()
-					handlerFunc(msg)
-				}()
-				// Update lastMessageID to acknowledge processing.
-				lastMessageID = xMessage.ID
+		var group redis.XInfoGroup
+		for i := 0; i < len(fields); i += 2 {
+			name, _ := fields[i].(string)
+			switch name {
+			case "name", "last-delivered-id":
+				value, ok := fields[i+1].(string)
+				if !ok {
+					return nil, fmt.Errorf("unexpected XINFO GROUPS %s %v", name, fields[i+1])
+				}
+				if name == "name" {
+					group.Name = value
+				} else {
+					group.LastDeliveredID = value
+				}
 			}
 		}
-		wg.Wait()
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// markShardReady records that a stream has replayed its history, the broker is ready once all of them have.
+// A stream that replays its history again, e.g. when Consume is restarted, is only counted once.
+func (r *RedisMessageBroker) markShardReady(stream string) {
+	r.mutex.Lock()
+	r.readyShards[stream] = struct{}{}
+	ready := len(r.readyShards) >= r.shards
+	r.mutex.Unlock()
+
+	if ready {
+		r.readyOnce.Do(func() {
+			close(r.ready)
+		})
+	}
+}
+
+func (r *RedisMessageBroker) setPosition(stream, id string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.positions[stream] = id
+}
+
+func (r *RedisMessageBroker) getPosition(stream string) string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.positions[stream]
+}
+
+// streams returns the names of all the streams the messages are sharded over.
+func (r *RedisMessageBroker) streams() []string {
+	if r.shards <= 1 {
+		return []string{r.stream}
+	}
+
+	streams := make([]string, r.shards)
+	for i := range streams {
+		streams[i] = fmt.Sprintf("%s:%d", r.stream, i)
+	}
+	return streams
+}
+
+// streamForKey returns the stream a message with the given key is published to.
+func (r *RedisMessageBroker) streamForKey(key string) string {
+	if r.shards <= 1 {
+		return r.stream
 	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%s:%d", r.stream, h.Sum32()%uint32(r.shards))
 }
 
-func (r *RedisMessageBroker) loadInitialMessageID() string {
+// loadInitialMessageID returns the ID to start consuming after and records it as the current position.
+func (r *RedisMessageBroker) loadInitialMessageID(ctx context.Context, stream string) string {
 	lastMessageID := "$"
 
 	if r.initialLoadOffset > 0 {
-		// Calculate the timestamp for one minute ago
-		oneMinuteAgo := time.Now().Add(-1 * r.initialLoadOffset)
+		// Stream IDs are prefixed with the entry's Unix time in milliseconds
+		loadFrom := time.Now().Add(-1 * r.initialLoadOffset)
+
+		lastMessageID = strconv.FormatInt(loadFrom.UnixMilli(), 10)
+	} else {
+		// Resolve "$" to the newest message so the lag can be measured from it
+		latest, err := r.client.XRevRangeN(ctx, stream, "+", "-", 1).Result()
+		if err != nil {
+			r.logger.Error("error reading latest message ID", slog.Any("error", err.Error()))
+			return lastMessageID
+		}
 
-		lastMessageID = strconv.FormatInt(oneMinuteAgo.Unix(), 10)
+		lastMessageID = "0-0"
+		if len(latest) > 0 {
+			lastMessageID = latest[0].ID
+		}
 	}
 
+	r.setPosition(stream, lastMessageID)
 	return lastMessageID
 }
+
+// parseStreamID splits a stream ID into its millisecond time and sequence number.
+// The sequence number is optional and defaults to 0.
+func parseStreamID(id string) (int64, int64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseInt(msPart, 10, 64)
+	seq, _ := strconv.ParseInt(seqPart, 10, 64)
+	return ms, seq
+}
+
+// streamIDAfter reports whether stream ID a is after stream ID b.
+func streamIDAfter(a, b string) bool {
+	aMs, aSeq := parseStreamID(a)
+	bMs, bSeq := parseStreamID(b)
+	return aMs > bMs || (aMs == bMs && aSeq > bSeq)
+}
+
+// nextStreamID returns the smallest stream ID after id, used as an exclusive range start.
+func nextStreamID(id string) string {
+	ms, seq := parseStreamID(id)
+	return fmt.Sprintf("%d-%d", ms, seq+1)
+}
+
+// encode encodes a Message as the fields of a Redis stream entry, using the codec if one is configured.
+func (r *RedisMessageBroker) encode(message Message) (map[string]interface{}, error) {
+	if r.codec == nil {
+		return encodeMessage(message), nil
+	}
+
+	payload, err := r.codec.Encode(message)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{fieldPayload: payload}, nil
+}
+
+// decode decodes the fields of a Redis stream entry, using the codec if one is configured.
+func (r *RedisMessageBroker) decode(values map[string]interface{}) (Message, error) {
+	if r.codec == nil {
+		return decodeMessage(values)
+	}
+
+	payload, ok := values[fieldPayload].(string)
+	if !ok {
+		return Message{}, fmt.Errorf("missing field %q", fieldPayload)
+	}
+	return r.codec.Decode([]byte(payload))
+}
+
+// encodeMessage encodes a Message as the fields of a Redis stream entry.
+func encodeMessage(message Message) map[string]interface{} {
+	timestamp := zeroTimestampValue
+	if !message.Timestamp.IsZero() {
+		timestamp = strconv.FormatInt(message.Timestamp.UnixNano(), 10)
+	}
+
+	values := map[string]interface{}{
+		fieldVersion:   wireVersion,
+		fieldBrokerID:  message.BrokerID,
+		fieldEvent:     message.Event,
+		fieldTimestamp: timestamp,
+		fieldKey:       message.Key,
+	}
+
+	if message.ID != "" {
+		values[fieldID] = message.ID
+	}
+	if message.Signature != "" {
+		values[fieldSignature] = message.Signature
+	}
+	if message.MaxRequests != 0 {
+		values[fieldMaxRequests] = strconv.Itoa(message.MaxRequests)
+	}
+	if message.Window != 0 {
+		values[fieldWindow] = strconv.FormatInt(int64(message.Window), 10)
+	}
+	if message.Duration != 0 {
+		values[fieldDuration] = strconv.FormatInt(int64(message.Duration), 10)
+	}
+	if message.TraceParent != "" {
+		values[fieldTraceParent] = message.TraceParent
+	}
+	if message.Count != 0 {
+		values[fieldCount] = strconv.Itoa(message.Count)
+	}
+
+	return values
+}
+
+// decodeMessage decodes the fields of a Redis stream entry into a Message.
+// Every field apart from the ID, signature, trace context, count and the fields of control events must be present and the version must match wireVersion.
+// The timestamp is returned in UTC.
+func decodeMessage(values map[string]interface{}) (Message, error) {
+	field := func(name string) (string, error) {
+		value, ok := values[name]
+		if !ok {
+			return "", fmt.Errorf("missing field %q", name)
+		}
+
+		str, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("field %q is a %T, expected a string", name, value)
+		}
+		return str, nil
+	}
+
+	var message Message
+
+	version, err := field(fieldVersion)
+	if err != nil {
+		return message, err
+	}
+	if version != wireVersion {
+		return message, fmt.Errorf("unsupported message version %q", version)
+	}
+
+	if message.BrokerID, err = field(fieldBrokerID); err != nil {
+		return message, err
+	}
+	if message.Event, err = field(fieldEvent); err != nil {
+		return message, err
+	}
+	if message.Key, err = field(fieldKey); err != nil {
+		return message, err
+	}
+
+	if _, ok := values[fieldID]; ok {
+		if message.ID, err = field(fieldID); err != nil {
+			return message, err
+		}
+	}
+	if _, ok := values[fieldSignature]; ok {
+		if message.Signature, err = field(fieldSignature); err != nil {
+			return message, err
+		}
+	}
+	if _, ok := values[fieldTraceParent]; ok {
+		if message.TraceParent, err = field(fieldTraceParent); err != nil {
+			return message, err
+		}
+	}
+
+	optionalInt := func(name string) (int64, error) {
+		if _, ok := values[name]; !ok {
+			return 0, nil
+		}
+		str, err := field(name)
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid field %q: %w", name, err)
+		}
+		return n, nil
+	}
+
+	maxRequests, err := optionalInt(fieldMaxRequests)
+	if err != nil {
+		return message, err
+	}
+	message.MaxRequests = int(maxRequests)
+
+	window, err := optionalInt(fieldWindow)
+	if err != nil {
+		return message, err
+	}
+	message.Window = time.Duration(window)
+
+	duration, err := optionalInt(fieldDuration)
+	if err != nil {
+		return message, err
+	}
+	message.Duration = time.Duration(duration)
+
+	count, err := optionalInt(fieldCount)
+	if err != nil {
+		return message, err
+	}
+	message.Count = int(count)
+
+	timestamp, err := field(fieldTimestamp)
+	if err != nil {
+		return message, err
+	}
+	if timestamp != zeroTimestampValue {
+		nanos, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return message, fmt.Errorf("invalid timestamp %q: %w", timestamp, err)
+		}
+		message.Timestamp = time.Unix(0, nanos).UTC()
+	}
+
+	return message, nil
+}
@@ -4,12 +4,18 @@ package ratebroker_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/parkerroan/ratebroker"
 	"github.com/stretchr/testify/assert"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
 func TestRedisMessageBroker(t *testing.T) {
@@ -62,3 +68,492 @@ func TestRedisMessageBroker(t *testing.T) {
 		t.Fatal("Test timed out before message was received")
 	}
 }
+
+func TestRedisMessageBroker_ReadyAfterReplay(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-ready-stream"
+	rdb.Del(ctx, stream)
+
+	publisher := ratebroker.NewRedisMessageBroker(rdb, ratebroker.WithStream(stream))
+
+	// Preload more than a single read worth of history
+	const preloaded = 250
+	for i := 0; i < preloaded; i++ {
+		err := publisher.Publish(ctx, ratebroker.Message{
+			BrokerID:  "test-ratebroker",
+			Event:     ratebroker.RequestAccepted,
+			Timestamp: time.Now(),
+			Key:       "user1",
+		})
+		assert.NoError(t, err, "Failed to publish message")
+	}
+
+	consumer := ratebroker.NewRedisMessageBroker(rdb,
+		ratebroker.WithStream(stream),
+		ratebroker.WithInitLoadOffset(time.Minute),
+	)
+
+	var mu sync.Mutex
+	received := 0
+	go consumer.Consume(ctx, func(msg ratebroker.Message) {
+		mu.Lock()
+		received++
+		mu.Unlock()
+	})
+
+	select {
+	case <-consumer.Ready():
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the broker replayed its history")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, preloaded, received, "Broker should be ready only after replaying all history")
+}
+
+func TestRedisMessageBroker_ConsumerGroupResume(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-group-stream"
+	rdb.Del(ctx, stream)
+
+	publish := func(broker *ratebroker.RedisMessageBroker, n int) {
+		for i := 0; i < n; i++ {
+			err := broker.Publish(ctx, ratebroker.Message{
+				BrokerID:  "test-ratebroker",
+				Event:     ratebroker.RequestAccepted,
+				Timestamp: time.Now(),
+				Key:       "user1",
+			})
+			assert.NoError(t, err, "Failed to publish message")
+		}
+	}
+
+	// consume runs a consumer until it has replayed its history and returns the number of messages it received
+	consume := func() int {
+		consumeCtx, stop := context.WithCancel(ctx)
+		defer stop()
+
+		consumer := ratebroker.NewRedisMessageBroker(rdb,
+			ratebroker.WithStream(stream),
+			ratebroker.WithConsumerGroup("replica-1"),
+		)
+
+		var mu sync.Mutex
+		received := 0
+		go consumer.Consume(consumeCtx, func(msg ratebroker.Message) {
+			mu.Lock()
+			received++
+			mu.Unlock()
+		})
+
+		select {
+		case <-consumer.Ready():
+		case <-ctx.Done():
+			t.Fatal("Test timed out before the broker replayed its history")
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+
+	publisher := ratebroker.NewRedisMessageBroker(rdb, ratebroker.WithStream(stream))
+
+	// The first start creates the group at the end of the stream
+	publish(publisher, 5)
+	assert.Equal(t, 0, consume(), "New group should start after the existing messages")
+
+	// Messages published while the replica is down are replayed on restart
+	publish(publisher, 3)
+	assert.Equal(t, 3, consume(), "Restarted consumer should resume from its last acknowledged message")
+	assert.Equal(t, 0, consume(), "Acknowledged messages should not be replayed")
+}
+
+// failingAcks is a redis.Hook failing the XACK commands while failures remain.
+type failingAcks struct {
+	failures atomic.Int32
+}
+
+func (h *failingAcks) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	if cmd.Name() == "xack" && h.failures.Add(-1) >= 0 {
+		return ctx, errors.New("ack failed")
+	}
+	return ctx, nil
+}
+
+func (h *failingAcks) AfterProcess(context.Context, redis.Cmder) error { return nil }
+
+func (h *failingAcks) BeforeProcessPipeline(ctx context.Context, _ []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failingAcks) AfterProcessPipeline(context.Context, []redis.Cmder) error { return nil }
+
+func TestRedisMessageBroker_ConsumerGroupAckRetry(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-group-ack-stream"
+	rdb.Del(ctx, stream)
+	assert.NoError(t, rdb.XGroupCreateMkStream(ctx, stream, "replica-1", "$").Err())
+
+	publisher := ratebroker.NewRedisMessageBroker(rdb, ratebroker.WithStream(stream))
+	publish := func() {
+		for i := 0; i < 5; i++ {
+			err := publisher.Publish(ctx, ratebroker.Message{BrokerID: "test-ratebroker", Event: ratebroker.RequestAccepted, Timestamp: time.Now(), Key: "user1"})
+			assert.NoError(t, err, "Failed to publish message")
+		}
+	}
+
+	// Messages delivered to the consumer before it stopped without acknowledging them
+	publish()
+	err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "replica-1", Consumer: "replica-1", Streams: []string{stream, ">"}}).Err()
+	assert.NoError(t, err)
+
+	// The first acks of the restarted consumer fail
+	client := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	hook := &failingAcks{}
+	hook.failures.Store(2)
+	client.AddHook(hook)
+
+	consumer := ratebroker.NewRedisMessageBroker(client,
+		ratebroker.WithStream(stream),
+		ratebroker.WithConsumerGroup("replica-1"),
+	)
+	var received atomic.Int32
+	go consumer.Consume(ctx, func(ratebroker.Message) {
+		received.Add(1)
+	})
+	<-consumer.Ready()
+	publish()
+
+	for received.Load() < 10 || pending(t, ctx, stream) > 0 {
+		if ctx.Err() != nil {
+			t.Fatalf("Test timed out with %d messages received", received.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Give the consumer the time to hand a message twice
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(10), received.Load(), "Messages should be handed to the handler once while acks fail")
+	assert.Less(t, hook.failures.Load(), int32(0), "Failed acks should be retried")
+}
+
+// pending returns the number of messages delivered to the consumer group of the stream and not acknowledged.
+func pending(t *testing.T, ctx context.Context, stream string) int64 {
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	info, err := rdb.XPending(ctx, stream, "replica-1").Result()
+	if err != nil {
+		t.Fatalf("Unexpected error reading pending messages: %v", err)
+	}
+	return info.Count
+}
+
+func TestRedisMessageBroker_Lag(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-lag-stream"
+	rdb.Del(ctx, stream)
+
+	broker := ratebroker.NewRedisMessageBroker(rdb, ratebroker.WithStream(stream))
+
+	consumeCtx, stop := context.WithCancel(ctx)
+	consumed := make(chan struct{}, 1)
+	go broker.Consume(consumeCtx, func(msg ratebroker.Message) {
+		consumed <- struct{}{}
+	})
+	<-broker.Ready()
+
+	err := broker.Publish(ctx, ratebroker.Message{BrokerID: "test-ratebroker", Event: ratebroker.RequestAccepted, Timestamp: time.Now(), Key: "user1"})
+	assert.NoError(t, err, "Failed to publish message")
+	<-consumed
+
+	lag, err := broker.Lag(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, ratebroker.Lag{}, lag, "Consumer should not lag after consuming every message")
+
+	// Stop consuming and publish more messages
+	stop()
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+		err := broker.Publish(ctx, ratebroker.Message{BrokerID: "test-ratebroker", Event: ratebroker.RequestAccepted, Timestamp: time.Now(), Key: "user1"})
+		assert.NoError(t, err, "Failed to publish message")
+	}
+
+	lag, err = broker.Lag(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), lag.Messages)
+	assert.Greater(t, lag.Latency, time.Duration(0))
+}
+
+func TestRedisMessageBroker_Shards(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const shards = 4
+	for i := 0; i < shards; i++ {
+		rdb.Del(ctx, fmt.Sprintf("test-shard-stream:%d", i))
+	}
+
+	broker := ratebroker.NewRedisMessageBroker(rdb,
+		ratebroker.WithStream("test-shard-stream"),
+		ratebroker.WithShards(shards),
+	)
+
+	var mu sync.Mutex
+	received := make(map[string]int)
+	go broker.Consume(ctx, func(msg ratebroker.Message) {
+		mu.Lock()
+		received[msg.Key]++
+		mu.Unlock()
+	})
+	<-broker.Ready()
+
+	const keys = 20
+	for i := 0; i < keys; i++ {
+		err := broker.Publish(ctx, ratebroker.Message{
+			BrokerID:  "test-ratebroker",
+			Event:     ratebroker.RequestAccepted,
+			Timestamp: time.Now(),
+			Key:       fmt.Sprintf("user%d", i),
+		})
+		assert.NoError(t, err, "Failed to publish message")
+	}
+
+	// The keys should be spread over more than one stream
+	used := 0
+	for i := 0; i < shards; i++ {
+		if rdb.XLen(ctx, fmt.Sprintf("test-shard-stream:%d", i)).Val() > 0 {
+			used++
+		}
+	}
+	assert.Greater(t, used, 1, "Messages should be spread over the shards")
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == keys
+	}, 5*time.Second, 10*time.Millisecond, "Every message should be consumed from its shard")
+}
+
+func TestRedisMessageBroker_SkipsMalformed(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-malformed-stream"
+	deadLetters := "test-malformed-stream-dead-letters"
+	rdb.Del(ctx, stream, deadLetters)
+
+	broker := ratebroker.NewRedisMessageBroker(rdb,
+		ratebroker.WithStream(stream),
+		ratebroker.WithDeadLetterStream(deadLetters),
+	)
+
+	received := make(chan ratebroker.Message, 1)
+	go broker.Consume(ctx, func(msg ratebroker.Message) {
+		received <- msg
+	})
+	<-broker.Ready()
+
+	// A message with a timestamp that cannot be decoded
+	err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		Values: map[string]interface{}{"v": "1", "broker_id": "test-ratebroker", "event": ratebroker.RequestAccepted, "ts": "yesterday", "key": "user1"},
+	}).Err()
+	assert.NoError(t, err, "Failed to add malformed message")
+
+	err = broker.Publish(ctx, ratebroker.Message{BrokerID: "test-ratebroker", Event: ratebroker.RequestAccepted, Timestamp: time.Now(), Key: "user1"})
+	assert.NoError(t, err, "Failed to publish message")
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, "user1", msg.Key, "Valid message after a malformed one should be consumed")
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the valid message was received")
+	}
+
+	stats := broker.ConsumerStats()
+	assert.Equal(t, uint64(1), stats.Malformed)
+	assert.Equal(t, uint64(1), stats.DeadLettered)
+	assert.Equal(t, int64(1), rdb.XLen(ctx, deadLetters).Val(), "Malformed message should be copied to the dead letter stream")
+}
+
+func TestRedisMessageBroker_Codec(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-codec-stream"
+	rdb.Del(ctx, stream)
+
+	broker := ratebroker.NewRedisMessageBroker(rdb,
+		ratebroker.WithStream(stream),
+		ratebroker.WithCodec(ratebroker.BinaryCodec{}),
+	)
+
+	received := make(chan ratebroker.Message, 1)
+	go broker.Consume(ctx, func(msg ratebroker.Message) {
+		received <- msg
+	})
+	<-broker.Ready()
+
+	original := ratebroker.Message{
+		BrokerID:  "test-ratebroker",
+		Event:     ratebroker.RequestAccepted,
+		Timestamp: time.Now(),
+		Key:       "user1",
+	}
+	assert.NoError(t, broker.Publish(ctx, original), "Failed to publish message")
+
+	select {
+	case msg := <-received:
+		assert.True(t, original.Timestamp.Equal(msg.Timestamp), "Timestamp should be preserved")
+		assert.Equal(t, original.Key, msg.Key)
+		assert.Equal(t, original.BrokerID, msg.BrokerID)
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the message was received")
+	}
+}
+
+func TestRedisMessageBroker_ConsumeSpanLinks(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-tracing-stream"
+	rdb.Del(ctx, stream)
+
+	recorder := tracetest.NewSpanRecorder()
+	broker := ratebroker.NewRedisMessageBroker(rdb,
+		ratebroker.WithStream(stream),
+		ratebroker.WithBrokerTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))),
+	)
+
+	received := make(chan ratebroker.Message, 1)
+	go broker.Consume(ctx, func(msg ratebroker.Message) {
+		received <- msg
+	})
+	<-broker.Ready()
+
+	traceParent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	assert.NoError(t, broker.Publish(ctx, ratebroker.Message{
+		BrokerID:    "test-ratebroker",
+		Event:       ratebroker.RequestAccepted,
+		Key:         "user1",
+		TraceParent: traceParent,
+	}), "Failed to publish message")
+
+	select {
+	case msg := <-received:
+		assert.Equal(t, traceParent, msg.TraceParent, "Trace context should be preserved")
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the message was received")
+	}
+
+	// The span ends once every handler of the batch returned
+	time.Sleep(50 * time.Millisecond)
+
+	var links []sdktrace.Link
+	for _, span := range recorder.Ended() {
+		if span.Name() == "ratebroker.Consume" {
+			links = append(links, span.Links()...)
+		}
+	}
+	if assert.Len(t, links, 1, "Consume span should link to the publishing span") {
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", links[0].SpanContext.TraceID().String())
+		assert.Equal(t, "00f067aa0ba902b7", links[0].SpanContext.SpanID().String())
+	}
+}
+
+func TestRedisMessageBroker_ControlOrder(t *testing.T) {
+	rdb := redis.NewClient(&redis.Options{
+		Addr: "localhost:6379",
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream := "test-control-order-stream"
+	rdb.Del(ctx, stream)
+
+	publisher := ratebroker.NewRedisMessageBroker(rdb, ratebroker.WithStream(stream))
+	publish := func(msg ratebroker.Message) {
+		msg.BrokerID = "test-ratebroker"
+		if msg.Timestamp.IsZero() {
+			msg.Timestamp = time.Now()
+		}
+		assert.NoError(t, publisher.Publish(ctx, msg), "Failed to publish message")
+	}
+
+	// Ban and unban pairs land in the same batch and must be applied in order
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user%d", i)
+		publish(ratebroker.Message{Event: ratebroker.KeyBanned, Key: key, Duration: time.Hour})
+		publish(ratebroker.Message{Event: ratebroker.KeyUnbanned, Key: key})
+	}
+
+	// Requests accepted before a reset are cleared by it, even when replayed after it
+	accepted := time.Now()
+	publish(ratebroker.Message{Event: ratebroker.RequestAccepted, Key: "reset", Timestamp: accepted})
+	publish(ratebroker.Message{Event: ratebroker.KeyReset, Key: "reset", Timestamp: accepted.Add(time.Millisecond)})
+	publish(ratebroker.Message{Event: ratebroker.RequestAccepted, Key: "reset", Timestamp: accepted})
+
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(ratebroker.NewRedisMessageBroker(rdb,
+			ratebroker.WithStream(stream),
+			ratebroker.WithInitLoadOffset(time.Minute),
+		)),
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+	)
+	rb.Start(ctx)
+
+	select {
+	case <-rb.Ready():
+	case <-ctx.Done():
+		t.Fatal("Test timed out before the broker replayed its history")
+	}
+
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user%d", i)
+		assert.True(t, rb.Usage(key).BannedUntil.IsZero(), "Unban of %s should be applied after its ban", key)
+	}
+	assert.Equal(t, 0, rb.Usage("reset").Used, "Requests accepted before the reset should be dropped")
+}
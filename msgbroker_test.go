@@ -0,0 +1,144 @@
+//go:build unit
+
+package ratebroker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageEncoding_RoundTrip(t *testing.T) {
+	zones := []*time.Location{
+		time.UTC,
+		time.Local,
+		time.FixedZone("UTC-8", -8*60*60),
+		time.FixedZone("UTC+5:45", 5*60*60+45*60),
+	}
+
+	for _, zone := range zones {
+		t.Run(zone.String(), func(t *testing.T) {
+			original := Message{
+				ID:        "event-1",
+				BrokerID:  "broker-1",
+				Event:     RequestAccepted,
+				Timestamp: time.Date(2023, 10, 29, 1, 30, 15, 123456789, zone),
+				Key:       "user1",
+				Signature: "key-1:c2lnbmF0dXJl",
+			}
+
+			decoded, err := decodeMessage(encodeMessage(original))
+			if err != nil {
+				t.Fatalf("Unexpected error decoding message: %v", err)
+			}
+
+			if !decoded.Timestamp.Equal(original.Timestamp) {
+				t.Errorf("Timestamp not preserved. Want: %v, got: %v", original.Timestamp, decoded.Timestamp)
+			}
+			if decoded.Timestamp.Nanosecond() != original.Timestamp.Nanosecond() {
+				t.Errorf("Nanosecond precision lost. Want: %d, got: %d", original.Timestamp.Nanosecond(), decoded.Timestamp.Nanosecond())
+			}
+			if decoded.BrokerID != original.BrokerID || decoded.Event != original.Event || decoded.Key != original.Key || decoded.ID != original.ID || decoded.Signature != original.Signature {
+				t.Errorf("Fields not preserved. Want: %+v, got: %+v", original, decoded)
+			}
+		})
+	}
+}
+
+func TestMessageEncoding_ControlFields(t *testing.T) {
+	original := Message{
+		ID:          "event-1",
+		BrokerID:    "broker-1",
+		Event:       PolicyUpdated,
+		Timestamp:   time.Now().UTC(),
+		Key:         "user1",
+		MaxRequests: 100,
+		Window:      90 * time.Second,
+		Duration:    time.Hour,
+		Count:       5,
+		TraceParent: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+
+	decoded, err := decodeMessage(encodeMessage(original))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding message: %v", err)
+	}
+	if decoded != original {
+		t.Errorf("Message not preserved. Want: %+v, got: %+v", original, decoded)
+	}
+
+	values := encodeMessage(Message{BrokerID: "broker-1", Event: RequestAccepted, Key: "user1"})
+	for _, name := range []string{fieldMaxRequests, fieldWindow, fieldDuration, fieldCount, fieldTraceParent} {
+		if _, ok := values[name]; ok {
+			t.Errorf("Unset field %q should not be stored", name)
+		}
+	}
+}
+
+func TestMessageEncoding_ZeroTimestamp(t *testing.T) {
+	decoded, err := decodeMessage(encodeMessage(Message{BrokerID: "broker-1", Event: RequestAccepted}))
+	if err != nil {
+		t.Fatalf("Unexpected error decoding message: %v", err)
+	}
+
+	if !decoded.Timestamp.IsZero() {
+		t.Errorf("Expected a zero timestamp, got %v", decoded.Timestamp)
+	}
+}
+
+func TestMessageEncoding_Strict(t *testing.T) {
+	valid := func() map[string]interface{} {
+		return encodeMessage(Message{BrokerID: "broker-1", Event: RequestAccepted, Timestamp: time.Now(), Key: "user1"})
+	}
+
+	testCases := []struct {
+		description string
+		modify      func(map[string]interface{})
+	}{
+		{"missing version", func(v map[string]interface{}) { delete(v, fieldVersion) }},
+		{"unknown version", func(v map[string]interface{}) { v[fieldVersion] = "2" }},
+		{"missing broker ID", func(v map[string]interface{}) { delete(v, fieldBrokerID) }},
+		{"missing event", func(v map[string]interface{}) { delete(v, fieldEvent) }},
+		{"missing key", func(v map[string]interface{}) { delete(v, fieldKey) }},
+		{"missing timestamp", func(v map[string]interface{}) { delete(v, fieldTimestamp) }},
+		{"formatted timestamp", func(v map[string]interface{}) { v[fieldTimestamp] = time.Now().Format(time.RFC3339Nano) }},
+		{"non string field", func(v map[string]interface{}) { v[fieldKey] = 42 }},
+		{"formatted window", func(v map[string]interface{}) { v[fieldWindow] = "1m" }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			values := valid()
+			tc.modify(values)
+
+			if _, err := decodeMessage(values); err == nil {
+				t.Error("Expected an error decoding the message")
+			}
+		})
+	}
+}
+
+func TestRedisMessageBroker_MarkShardReady(t *testing.T) {
+	broker := NewRedisMessageBroker(nil, WithShards(2))
+	streams := broker.streams()
+
+	isReady := func() bool {
+		select {
+		case <-broker.Ready():
+			return true
+		default:
+			return false
+		}
+	}
+
+	// A shard replaying its history again after Consume restarts is counted once
+	broker.markShardReady(streams[0])
+	broker.markShardReady(streams[0])
+	if isReady() {
+		t.Fatal("Broker should not be ready before every shard replayed its history")
+	}
+
+	broker.markShardReady(streams[1])
+	if !isReady() {
+		t.Error("Broker should be ready once every shard replayed its history")
+	}
+}
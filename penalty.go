@@ -0,0 +1,149 @@
+package ratebroker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/parkerroan/ratebroker/limiter"
+	"golang.org/x/exp/slog"
+)
+
+// PenaltyBox configures automatic bans for keys that keep sending requests after
+// being rejected, see WithPenaltyBox.
+type PenaltyBox struct {
+	// Threshold is the number of rejections within Period a key is allowed,
+	// the next rejection bans it. Zero bans keys on their first rejection.
+	Threshold int
+	Period    time.Duration
+	// BanDuration is how long the first ban lasts. Every following ban doubles it,
+	// up to MaxBanDuration, until the key stays out of trouble for MaxBanDuration
+	// after its last ban. A zero MaxBanDuration disables the escalation.
+	BanDuration    time.Duration
+	MaxBanDuration time.Duration
+}
+
+// WithPenaltyBox bans keys that are rejected more than box.Threshold times within
+// box.Period, fail2ban style, so that clients hammering the limit are rejected without
+// a limiter lookup. Bans are broadcast through the broker like the ones from BanKey,
+// and reported in the LimitDetails returned by TryAccept.
+//
+// Rejections are counted per replica, and forgotten along with the key's limiter
+// when it is evicted from the cache. An invalid box, e.g. without a BanDuration, is
+// logged and disables the penalty box.
+func WithPenaltyBox(box PenaltyBox) Option {
+	return func(rb *RateBroker) {
+		rb.penaltyBox = &box
+	}
+}
+
+// validate checks that the box can ban keys.
+func (box *PenaltyBox) validate() error {
+	switch {
+	case box.Threshold < 0:
+		return errors.New("threshold cannot be negative")
+	case box.Threshold > 0 && box.Period <= 0:
+		return errors.New("period must be positive with a threshold")
+	case box.BanDuration <= 0:
+		return errors.New("ban duration must be positive")
+	case box.MaxBanDuration < 0:
+		return errors.New("max ban duration cannot be negative")
+	}
+	return nil
+}
+
+// penaltyState tracks the rejections and bans of a key for the penalty box.
+type penaltyState struct {
+	mutex      sync.Mutex
+	rejections limiter.Limiter
+	bans       int       // Number of consecutive bans, used to escalate their duration
+	lastBanEnd time.Time // When the last ban ended or ends
+}
+
+func (rb *RateBroker) newPenaltyState() *penaltyState {
+	if rb.penaltyBox == nil {
+		return nil
+	}
+
+	return &penaltyState{
+		rejections: newRejectionLimiter(rb.penaltyBox),
+	}
+}
+
+// newRejectionLimiter counts the rejections allowed by the box, it returns nil when the
+// first rejection bans the key.
+func newRejectionLimiter(box *PenaltyBox) limiter.Limiter {
+	if box.Threshold == 0 {
+		return nil
+	}
+	return limiter.NewRingLimiter(box.Threshold, box.Period)
+}
+
+// penalize records a rejection of the key and bans it once it crossed the threshold.
+// It returns when the key is banned until, or the zero time if it is not.
+func (rb *RateBroker) penalize(ctx context.Context, key string, entry *keyEntry, now time.Time) time.Time {
+	if entry.penalty == nil {
+		return time.Time{}
+	}
+
+	duration := entry.penalty.record(rb.penaltyBox, now)
+	if duration == 0 {
+		return time.Time{}
+	}
+
+	message := Message{
+		ID:        uuid.NewString(),
+		BrokerID:  rb.id,
+		Event:     KeyBanned,
+		Timestamp: now,
+		Key:       key,
+		Duration:  duration,
+	}
+	rb.logger.Info("banning key", slog.String("key", key), slog.Duration("duration", duration))
+
+	if err := rb.applyControl(message); err != nil {
+		rb.logger.Error("error banning key", slog.Any("error", err.Error()))
+		return time.Time{}
+	}
+
+	// In shadow mode the ban only marks the key's requests as would be rejected, replicas
+	// enforcing their limits sharing the broker must not enforce it
+	if rb.broker != nil && !rb.shadowMode {
+		if err := rb.publishEvent(ctx, message); err != nil {
+			rb.logger.Error("error publishing message", slog.Any("error", err.Error()))
+		}
+	}
+
+	return now.Add(duration)
+}
+
+// record records a rejection at now and returns how long to ban the key for, zero if it should not be banned.
+func (p *penaltyState) record(box *PenaltyBox, now time.Time) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.rejections != nil && p.rejections.TryAccept(now) {
+		return 0
+	}
+
+	// Keys that behaved since their last ban start over
+	if box.MaxBanDuration > 0 && now.Sub(p.lastBanEnd) > box.MaxBanDuration {
+		p.bans = 0
+	}
+
+	duration := box.BanDuration
+	for i := 0; i < p.bans && duration < box.MaxBanDuration; i++ {
+		duration *= 2
+	}
+	if box.MaxBanDuration > 0 && duration > box.MaxBanDuration {
+		duration = box.MaxBanDuration
+	}
+
+	p.bans++
+	p.lastBanEnd = now.Add(duration)
+	p.rejections = newRejectionLimiter(box)
+
+	return duration
+}
@@ -0,0 +1,41 @@
+//go:build unit
+
+package ratebroker
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateBroker_SweepControl(t *testing.T) {
+	ctx := context.Background()
+	rb := NewRateBroker(WithWindow(time.Minute))
+
+	if err := rb.BanKey(ctx, "10.0.0.1", time.Millisecond); err != nil {
+		t.Fatalf("Unexpected error banning key: %v", err)
+	}
+	if err := rb.ResetKey(ctx, "10.0.0.1"); err != nil {
+		t.Fatalf("Unexpected error resetting key: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// Pretend the last sweep was a while ago, and let the reset fall out of its window
+	rb.controlMutex.Lock()
+	rb.lastSweep = time.Time{}
+	rb.resets["10.0.0.1"] = rb.Now().Add(-2 * time.Minute)
+	rb.controlMutex.Unlock()
+
+	if err := rb.BanKey(ctx, "10.0.0.2", time.Hour); err != nil {
+		t.Fatalf("Unexpected error banning key: %v", err)
+	}
+
+	rb.controlMutex.RLock()
+	defer rb.controlMutex.RUnlock()
+	if _, ok := rb.bans["10.0.0.1"]; ok || len(rb.bans) != 1 {
+		t.Errorf("Expected the expired ban to be swept, got %v", rb.bans)
+	}
+	if len(rb.resets) != 0 {
+		t.Errorf("Expected the reset older than the window to be swept, got %v", rb.resets)
+	}
+}
@@ -0,0 +1,139 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+)
+
+func TestRateBroker_PenaltyBox(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	newReplica := func() *ratebroker.RateBroker {
+		rb := ratebroker.NewRateBroker(
+			ratebroker.WithBroker(broker),
+			ratebroker.WithMaxRequests(1),
+			ratebroker.WithWindow(time.Minute),
+			ratebroker.WithPenaltyBox(ratebroker.PenaltyBox{
+				Threshold:      2,
+				Period:         time.Minute,
+				BanDuration:    50 * time.Millisecond,
+				MaxBanDuration: time.Second,
+			}),
+		)
+		rb.Start(ctx)
+		return rb
+	}
+
+	replica1, replica2 := newReplica(), newReplica()
+	waitForConsumers(t, broker, 2)
+
+	if allowed, _ := replica1.TryAccept(ctx, "user1"); !allowed {
+		t.Fatal("First request should be allowed")
+	}
+
+	// Rejections up to the threshold do not ban the key
+	for i := 0; i < 2; i++ {
+		allowed, details := replica1.TryAccept(ctx, "user1")
+		if allowed {
+			t.Fatalf("Request %d over the limit should be rejected", i)
+		}
+		if !details.BannedUntil.IsZero() {
+			t.Fatalf("Rejection %d should not ban the key", i)
+		}
+	}
+
+	allowed, details := replica1.TryAccept(ctx, "user1")
+	if allowed || details.BannedUntil.IsZero() {
+		t.Fatalf("Rejection over the threshold should ban the key, got %+v", details)
+	}
+	firstBan := time.Until(details.BannedUntil)
+	time.Sleep(10 * time.Millisecond)
+
+	if _, details := replica2.TryAccept(ctx, "user1"); details.BannedUntil.IsZero() {
+		t.Error("Ban should be shared with the other replicas")
+	}
+	if _, details := replica1.TryAccept(ctx, "user2"); !details.BannedUntil.IsZero() {
+		t.Error("Other keys should not be banned")
+	}
+
+	time.Sleep(firstBan)
+
+	// Still over the limit, the next ban lasts twice as long
+	for i := 0; i < 2; i++ {
+		replica1.TryAccept(ctx, "user1")
+	}
+	_, details = replica1.TryAccept(ctx, "user1")
+	if secondBan := time.Until(details.BannedUntil); secondBan <= firstBan {
+		t.Errorf("Repeated bans should escalate, first %v, second %v", firstBan, secondBan)
+	}
+}
+
+func TestHttpMiddleware_RetryAfter(t *testing.T) {
+	rb := ratebroker.NewRateBroker(ratebroker.WithMaxRequests(10))
+	if err := rb.BanKey(context.Background(), "user1", 90*time.Second); err != nil {
+		t.Fatalf("Unexpected error banning key: %v", err)
+	}
+
+	handler := ratebroker.HttpMiddleware(rb, func(r *http.Request) string {
+		return r.Header.Get("X-User-ID")
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for key, expected := range map[string]string{"user1": "90", "user2": ""} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("X-User-ID", key)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if retryAfter := rec.Header().Get("Retry-After"); retryAfter != expected {
+			t.Errorf("%s: expected Retry-After %q, got %q", key, expected, retryAfter)
+		}
+	}
+}
+
+func TestRateBroker_PenaltyBoxZeroThreshold(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithPenaltyBox(ratebroker.PenaltyBox{BanDuration: time.Minute}),
+	)
+
+	rb.TryAccept(context.Background(), "user1")
+	if allowed, details := rb.TryAccept(context.Background(), "user1"); allowed || details.BannedUntil.IsZero() {
+		t.Errorf("Expected the first rejection to ban the key, got %+v", details)
+	}
+}
+
+func TestRateBroker_PenaltyBoxInvalid(t *testing.T) {
+	boxes := map[string]ratebroker.PenaltyBox{
+		"no ban duration":          {Threshold: 1, Period: time.Minute},
+		"threshold without period": {Threshold: 1, BanDuration: time.Minute},
+		"negative threshold":       {Threshold: -1, Period: time.Minute, BanDuration: time.Minute},
+	}
+
+	for name, box := range boxes {
+		t.Run(name, func(t *testing.T) {
+			rb := ratebroker.NewRateBroker(
+				ratebroker.WithMaxRequests(1),
+				ratebroker.WithWindow(time.Minute),
+				ratebroker.WithPenaltyBox(box),
+			)
+
+			for i := 0; i < 3; i++ {
+				if _, details := rb.TryAccept(context.Background(), "user1"); !details.BannedUntil.IsZero() {
+					t.Fatalf("Expected an invalid penalty box to be disabled, got %+v", details)
+				}
+			}
+		})
+	}
+}
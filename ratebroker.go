@@ -2,17 +2,30 @@ package ratebroker
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"log"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/beevik/ntp"
 	"github.com/dgraph-io/ristretto"
 	"github.com/google/uuid"
+	"github.com/jpillora/backoff"
 	"github.com/parkerroan/ratebroker/limiter"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 	"golang.org/x/sync/semaphore"
 )
 
+// ErrLagNotSupported is returned by ConsumerLag when the broker does not implement LagReporter.
+var ErrLagNotSupported = errors.New("broker does not report consumer lag")
+
 // Option is a function that can be passed into NewRateBroker to configure the RateBroker.
 type Option func(*RateBroker)
 
@@ -23,6 +36,19 @@ type NewLimiterFunc func(int, time.Duration) limiter.Limiter
 type LimitDetails struct {
 	MaxRequests int
 	Window      time.Duration
+	// BannedUntil is set when the request was rejected because the key is banned,
+	// by BanKey or by the penalty box, see WithPenaltyBox.
+	BannedUntil time.Time
+	// WouldReject is set in shadow mode when the request was allowed but would
+	// have been rejected otherwise, see WithShadowMode.
+	WouldReject bool
+}
+
+// CheckResult is the result of Check.
+type CheckResult struct {
+	Allowed  bool
+	Decision string // One of the Decision constants
+	LimitDetails
 }
 
 // RateBroker is the main structure that will use a Limiter to enforce rate limits.
@@ -37,6 +63,48 @@ type RateBroker struct {
 	sem            *semaphore.Weighted
 	ntpClient      *ntp.Response // add an NTP client field
 	ntpServer      string
+	ready          chan struct{}
+	readyOnce      sync.Once
+	health         ConsumerHealth
+	healthMutex    sync.Mutex
+	keySecret      []byte
+	startedAt      time.Time
+	entryMutexes   [entryShards]sync.Mutex // Serialize the creation of the entries of a shard of the keys
+	bans           map[string]time.Time    // Keys banned by KeyBanned events, until when
+	resets         map[string]time.Time    // Keys reset by KeyReset events, when, see sweepControl
+	lastSweep      time.Time               // Last run of sweepControl
+	policies       map[string]LimitDetails // Per key limits set by PolicyUpdated events
+	allowList      *accessList
+	denyList       *accessList
+	penaltyBox     *PenaltyBox
+	config         *configState // Set by ApplyConfig
+	shadowMode     bool
+	onShadowReject func(key string, details LimitDetails)
+	shadowRejects  atomic.Uint64
+	metrics        Metrics
+	tracer         trace.Tracer
+	logger         *slog.Logger
+	logSampling    logSampling
+	hooks          hooks
+	heavyHitters   *heavyHitters        // Set by WithHeavyHitters
+	keys           map[string]*keyEntry // The entries in the cache, see TrackedKeys
+	keysMutex      sync.Mutex
+	controlMutex   sync.RWMutex
+}
+
+// keyEntry is the state tracked for each key in the cache.
+type keyEntry struct {
+	key     string
+	limiter limiter.Limiter
+	// limiterType is the limiter type selected by the config, empty when created by newLimiterFunc
+	limiterType string
+	// seen holds the IDs of the recent events applied from the broker
+	seen *dedupeWindow
+	// penalty is set when the penalty box is enabled
+	penalty *penaltyState
+	// policy is the limit the limiter was created or last resized with, compared to the
+	// key's policy rather than the limiter's LimitDetails, which custom limiters may round
+	policy atomic.Pointer[LimitDetails]
 }
 
 // NewRateBroker creates a RateLimiter with the provided Limiter.
@@ -49,12 +117,30 @@ func NewRateBroker(opts ...Option) *RateBroker {
 		broker:         nil,
 		maxRequests:    30,
 		window:         10 * time.Second,
+		ready:          make(chan struct{}),
+		bans:           make(map[string]time.Time),
+		resets:         make(map[string]time.Time),
+		policies:       make(map[string]LimitDetails),
+		allowList:      newAccessList(),
+		denyList:       newAccessList(),
+		metrics:        nopMetrics{},
+		tracer:         noopTracer,
+		logSampling:    defaultLogSampling,
+		keys:           make(map[string]*keyEntry),
 	}
 
 	// Apply all provided options
 	for _, opt := range opts {
 		opt(rb)
 	}
+	rb.logger = rb.logSampling.newLogger(rb.logger)
+
+	if rb.penaltyBox != nil {
+		if err := rb.penaltyBox.validate(); err != nil {
+			rb.logger.Error("invalid penalty box, disabling it", slog.Any("error", err.Error()))
+			rb.penaltyBox = nil
+		}
+	}
 
 	// Create a new cache with a high size limit (adjust as needed) if one is not provided
 	if rb.cache == nil {
@@ -62,6 +148,7 @@ func NewRateBroker(opts ...Option) *RateBroker {
 			NumCounters: 10000000, // Num keys to track frequency of (10M).
 			MaxCost:     1000000,  // Maximum cost of cache (1GB).
 			BufferItems: 64,       // Number of keys per Get buffer.
+			OnExit:      rb.untrackEntry,
 		})
 		if err != nil {
 			log.Fatal(err) // handle error according to your strategy
@@ -69,6 +156,15 @@ func NewRateBroker(opts ...Option) *RateBroker {
 		rb.cache = cache
 	}
 
+	// Our own messages published before this time were published by a previous
+	// run with the same ID and are applied when the broker replays them
+	rb.startedAt = rb.Now()
+
+	// Without a broker there is no history to wait for
+	if rb.broker == nil {
+		rb.markReady()
+	}
+
 	return rb
 }
 
@@ -125,6 +221,21 @@ func WithNTPServer(server string) Option {
 	}
 }
 
+// WithKeyHashing replaces every key passed to TryAccept with a keyed hash (HMAC-SHA256)
+// of it before it is tracked or broadcast, so keys containing PII such as IP addresses
+// or user IDs never leave the process. Every replica must use the same secret for the
+// limits to line up across pods.
+//
+// The hash is truncated to 64 bits and formatted as 16 hexadecimal characters, the
+// same form as HashKey, so a BinaryCodec with HashKeys stores it in 8 bytes. Exact
+// allow and deny list entries are hashed too, but prefixes and CIDR ranges are
+// broadcast in plain text, see AddToAllowList.
+func WithKeyHashing(secret []byte) Option {
+	return func(rb *RateBroker) {
+		rb.keySecret = secret
+	}
+}
+
 // WithLimiterContructorFunc sets the function used to create a new limiter.
 // The default is limiter.NewRingLimiterConstructorFunc()
 // If you want to use a different limiter, you can pass in a function that creates it.
@@ -140,17 +251,106 @@ func WithLimiterContructorFunc(limiterFunc NewLimiterFunc) Option {
 // and handling them in the background.
 func (rb *RateBroker) Start(ctx context.Context) {
 	if rb.broker == nil {
-		slog.Info("no broker configured, ignoring start")
+		rb.logger.Info("no broker configured, ignoring start")
 		return
 	}
 
+	go rb.consume(ctx)
+
 	go func() {
-		err := rb.broker.Consume(ctx, rb.brokerHandleFunc)
-		if err != nil {
-			slog.Error("error consuming messages", slog.Any("error", err.Error()))
+		// Wait for the broker to replay its history if it supports reporting it
+		if notifier, ok := rb.broker.(ReadinessNotifier); ok {
+			select {
+			case <-notifier.Ready():
+			case <-ctx.Done():
+				return
+			}
 		}
+		rb.markReady()
 	}()
+}
 
+// consume runs the broker's Consume and restarts it with backoff whenever it
+// returns an error, until the context is done.
+func (rb *RateBroker) consume(ctx context.Context) {
+	retry := backoff.Backoff{
+		Min:    100 * time.Millisecond,
+		Max:    10 * time.Second,
+		Factor: 2,
+	}
+
+	for {
+		rb.setConsuming(true, nil)
+		started := time.Now()
+		err := rb.broker.Consume(ctx, rb.brokerHandleFunc)
+		if ctx.Err() != nil {
+			rb.setConsuming(false, nil)
+			return
+		}
+
+		if err == nil {
+			err = errors.New("consumer stopped")
+		}
+		rb.logger.Error("error consuming messages, restarting", slog.Any("error", err.Error()))
+		rb.setConsuming(false, err)
+
+		// A consumer that ran for a while before failing starts backing off from scratch
+		if time.Since(started) > retry.Max {
+			retry.Reset()
+		}
+
+		select {
+		case <-time.After(retry.Duration()):
+		case <-ctx.Done():
+			return
+		}
+
+		rb.healthMutex.Lock()
+		rb.health.Restarts++
+		rb.healthMutex.Unlock()
+	}
+}
+
+// Ready returns a channel that is closed once the RateBroker is ready to serve traffic.
+//
+// When the broker implements ReadinessNotifier this happens after the broker has
+// replayed its initial history, otherwise as soon as Start is called. A RateBroker
+// without a broker is ready immediately.
+func (rb *RateBroker) Ready() <-chan struct{} {
+	return rb.ready
+}
+
+// IsReady reports whether the Ready channel has been closed.
+func (rb *RateBroker) IsReady() bool {
+	select {
+	case <-rb.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rb *RateBroker) markReady() {
+	rb.readyOnce.Do(func() {
+		close(rb.ready)
+	})
+}
+
+// ID returns the ID of the RateBroker used to identify the messages it publishes.
+func (rb *RateBroker) ID() string {
+	return rb.id
+}
+
+// ConsumerLag reports how far the broker's consumer is behind the messages published
+// by the other replicas. It returns ErrLagNotSupported if the broker does not
+// implement LagReporter.
+func (rb *RateBroker) ConsumerLag(ctx context.Context) (Lag, error) {
+	reporter, ok := rb.broker.(LagReporter)
+	if !ok {
+		return Lag{}, ErrLagNotSupported
+	}
+
+	return reporter.Lag(ctx)
 }
 
 // Now tries to get the time from the NTP server if available; otherwise, it uses the local time.
@@ -160,7 +360,7 @@ func (rb *RateBroker) Now() time.Time {
 		if rb.ntpClient == nil || time.Since(rb.ntpClient.Time) > 1*time.Minute { //re-fetch every minute
 			response, err := ntp.Query(rb.ntpServer)
 			if err != nil {
-				slog.Error("error querying NTP server", slog.Any("error", err.Error()))
+				rb.logger.Error("error querying NTP server", slog.Any("error", err.Error()))
 				return time.Now()
 			}
 			rb.ntpClient = response
@@ -173,37 +373,140 @@ func (rb *RateBroker) Now() time.Time {
 }
 
 // TryAccept is a method on RateLimiter that checks a new request against the current rate limit.
+//
+// In shadow mode, see WithShadowMode, it always allows the request and reports
+// whether it would have been rejected in LimitDetails.WouldReject.
 func (rb *RateBroker) TryAccept(ctx context.Context, key string) (bool, LimitDetails) {
+	return rb.TryAcceptN(ctx, key, 1)
+}
+
+// TryAcceptN checks n requests at once, e.g. a request with a cost of n, against the
+// current rate limit. Either all of them are accepted or none is. Costs lower than 1
+// count as 1.
+//
+// Limiters created by a NewLimiterFunc must implement limiter.CostLimiter to accept a
+// cost over 1, such requests are rejected by other limiters rather than pushing the key
+// over its limit. The built-in limiters implement it.
+func (rb *RateBroker) TryAcceptN(ctx context.Context, key string, n int) (bool, LimitDetails) {
+	result := rb.Check(ctx, key, n)
+	return result.Allowed, result.LimitDetails
+}
+
+// Check is TryAcceptN returning the decision along with the result, see Metrics.
+func (rb *RateBroker) Check(ctx context.Context, key string, n int) CheckResult {
+	ctx, span := rb.tracer.Start(ctx, "ratebroker.TryAccept")
+	defer span.End()
+
+	n = max(n, 1)
 	now := rb.Now()
+	storedKey := rb.StoredKey(key)
+	allowed, limitDetails, decision := rb.tryAccept(ctx, key, storedKey, n, now)
+	if !allowed && rb.shadowMode {
+		allowed, limitDetails = true, rb.shadowReject(key, storedKey, limitDetails)
+		decision = DecisionWouldReject
+	}
+
+	rb.metrics.ObserveDecision(decision)
+	if allowed {
+		callHooks(rb.hooks.accept, key, limitDetails, now)
+	} else {
+		callHooks(rb.hooks.reject, key, limitDetails, now)
+	}
+	if rb.heavyHitters != nil {
+		if allowed {
+			rb.heavyHitters.accepted.add(storedKey, uint64(n))
+		} else {
+			rb.heavyHitters.rejected.add(storedKey, uint64(n))
+		}
+	}
+	if span.IsRecording() {
+		span.SetAttributes(
+			attribute.String("ratebroker.key", storedKey),
+			attribute.String("ratebroker.decision", decision),
+			attribute.Int("ratebroker.cost", n),
+			attribute.Bool("ratebroker.allowed", allowed),
+			attribute.Int("ratebroker.max_requests", limitDetails.MaxRequests),
+			attribute.String("ratebroker.window", limitDetails.Window.String()),
+		)
+	}
+	return CheckResult{Allowed: allowed, Decision: decision, LimitDetails: limitDetails}
+}
+
+// tryAccept checks the request and returns the decision along with the result, see Metrics.
+func (rb *RateBroker) tryAccept(ctx context.Context, key, storedKey string, n int, now time.Time) (bool, LimitDetails, string) {
+	// Prefixes and CIDR ranges are matched against the original key, ranges need the IP address
+	denied, allowed := rb.checkAccessLists(key, storedKey)
+	key = storedKey
+	if denied {
+		return false, rb.policyFor(key), DecisionDenied
+	}
+	if allowed {
+		return true, rb.policyFor(key), DecisionAllowListed
+	}
 
-	var userLimit limiter.Limiter
-	if userLimit = rb.getLimiter(key); userLimit == nil {
-		userLimit = rb.newLimiterFunc(rb.maxRequests, rb.window)
-		rb.cache.Set(key, userLimit, 1)
+	if until, banned := rb.bannedUntil(key, now); banned {
+		limitDetails := rb.policyFor(key)
+		limitDetails.BannedUntil = until
+		return false, limitDetails, DecisionBanned
 	}
 
+	entry := rb.getOrCreateEntry(key)
+	userLimit := entry.limiter
+
 	var limitDetails LimitDetails
 	limitDetails.MaxRequests, limitDetails.Window = userLimit.LimitDetails()
 
-	if allow := userLimit.TryAccept(now); !allow {
-		return false, limitDetails
+	if allow := tryAcceptN(userLimit, now, n); !allow {
+		limitDetails.BannedUntil = rb.penalize(ctx, key, entry, now)
+		return false, limitDetails, DecisionRejected
 	}
 
 	if rb.broker != nil {
 		message := Message{
+			ID:        uuid.NewString(),
 			BrokerID:  rb.id,
 			Event:     RequestAccepted,
 			Timestamp: now,
 			Key:       key,
 		}
+		// Single requests leave the count unset, so that they are understood by
+		// replicas that do not know the field
+		if n > 1 {
+			message.Count = n
+		}
 
 		err := rb.publishEvent(ctx, message)
 		if err != nil {
-			slog.Error("error publishing message", slog.Any("error", err.Error()))
+			rb.logger.Error("error publishing message", slog.Any("error", err.Error()))
 		}
 	}
 
-	return true, limitDetails
+	return true, limitDetails, DecisionAccepted
+}
+
+// tryAcceptN counts n requests if they are within the limit, see TryAcceptN. Limiters
+// that do not implement limiter.CostLimiter cannot check several requests at once and
+// reject more than one.
+func tryAcceptN(l limiter.Limiter, now time.Time, n int) bool {
+	if n == 1 {
+		return l.TryAccept(now)
+	}
+	if costLimiter, ok := l.(limiter.CostLimiter); ok {
+		return costLimiter.TryAcceptN(now, n)
+	}
+	return false
+}
+
+// StoredKey returns the key under which the RateBroker tracks and broadcasts key.
+// This is the key itself unless WithKeyHashing is used, in which case it is its keyed hash.
+func (rb *RateBroker) StoredKey(key string) string {
+	if rb.keySecret == nil {
+		return key
+	}
+
+	mac := hmac.New(sha256.New, rb.keySecret)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
 }
 
 func (rb *RateBroker) publishEvent(ctx context.Context, msg Message) error {
@@ -212,59 +515,246 @@ func (rb *RateBroker) publishEvent(ctx context.Context, msg Message) error {
 		deferFunc = func() {
 			rb.sem.Release(1)
 		}
-		if err := rb.sem.Acquire(ctx, 1); err != nil {
-			slog.Error("Failed to acquire semaphore", slog.Any("error", err.Error()))
+		waitStart := time.Now()
+		err := rb.sem.Acquire(ctx, 1)
+		rb.metrics.ObserveSemaphoreWait(time.Since(waitStart))
+		if err != nil {
+			rb.logger.Error("Failed to acquire semaphore", slog.Any("error", err.Error()))
 			return err
 		}
 	}
 
+	// The publish outlives the request but is still traced as part of it
+	spanContext := trace.SpanContextFromContext(ctx)
+
 	go func(msg Message) {
-		slog.Debug("publishing message", slog.Any("message", msg))
-		publishCtx, cancel := context.WithTimeout(context.Background(), 1*time.Second) // Set your own timeout duration
+		rb.logger.Debug("publishing message", slog.Any("message", msg))
+		publishCtx := trace.ContextWithSpanContext(context.Background(), spanContext)
+		publishCtx, cancel := context.WithTimeout(publishCtx, 1*time.Second) // Set your own timeout duration
 		defer cancel()
 		defer deferFunc()
-		err := rb.broker.Publish(publishCtx, msg)
+		err := rb.publish(publishCtx, msg)
 		if err != nil {
-			slog.Error("error broker publish", slog.Any("error", err.Error()))
+			rb.logger.Error("error broker publish", slog.Any("error", err.Error()))
 		}
 	}(msg)
 
 	return nil
 }
 
+// publish publishes the message to the broker and reports it to the metrics. The message
+// carries the trace context of its span so that consumers can link back to it.
+func (rb *RateBroker) publish(ctx context.Context, msg Message) error {
+	ctx, span := rb.tracer.Start(ctx, "ratebroker.Publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attribute.String("ratebroker.event", msg.Event)),
+	)
+	defer span.End()
+	msg.TraceParent = injectTraceParent(ctx)
+
+	start := time.Now()
+	err := rb.broker.Publish(ctx, msg)
+	rb.metrics.ObservePublish(time.Since(start), err)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
 // BrokerHandleFunc is passed into the broker to handle incoming messages
 func (rb *RateBroker) brokerHandleFunc(message Message) {
-	slog.Debug("message received", slog.Any("message", message))
+	rb.logger.Debug("message received", slog.Any("message", message))
 
-	//return early as we don't want to process our own messages
-	if message.BrokerID == rb.id {
+	// return early as we don't want to process our own messages, unless they were
+	// published before we started by a previous run with the same ID and are replayed
+	if message.BrokerID == rb.id && !message.Timestamp.Before(rb.startedAt) {
 		return
 	}
 
-	if message.Timestamp.Before(rb.Now().Add(-1 * rb.window)) {
-		slog.Warn("message too old, ignoring", slog.Any("message", message))
+	switch message.Event {
+	case RequestAccepted:
+	case KeyReset, KeyBanned, KeyUnbanned, PolicyUpdated, LimitsUpdated,
+		AllowListAdded, AllowListRemoved, DenyListAdded, DenyListRemoved:
+		if err := rb.applyControl(message); err != nil {
+			rb.logger.Warn("invalid control message, ignoring", slog.Any("error", err.Error()), slog.Any("message", message))
+		}
+		return
+	default:
+		rb.logger.Warn("unknown event, ignoring", slog.Any("message", message))
 		return
 	}
 
-	limit := rb.getLimiter(message.Key)
-	if limit == nil {
-		limit = rb.newLimiterFunc(rb.maxRequests, rb.window)
-		rb.cache.Set(message.Key, limit, 1)
+	if message.Timestamp.Before(rb.Now().Add(-1 * rb.policyFor(message.Key).Window)) {
+		rb.logger.Warn("message too old, ignoring", slog.Any("message", message))
+		return
 	}
 
-	limit.Accept(message.Timestamp)
-}
+	// Requests accepted before the key was reset are cleared by the reset, even when
+	// they are replayed after it
+	if rb.resetBefore(message.Key, message.Timestamp) {
+		rb.logger.Debug("message before reset, ignoring", slog.Any("message", message))
+		return
+	}
+
+	entry := rb.getOrCreateEntry(message.Key)
+
+	// Ignore events that were already applied, e.g. when the broker replays its history
+	if message.ID != "" && !entry.seen.add(message.ID) {
+		rb.logger.Debug("duplicate message, ignoring", slog.Any("message", message))
+		return
+	}
+
+	// A request over the limit is never accepted, larger counts are malformed
+	maxRequests, _ := entry.limiter.LimitDetails()
+	count := min(max(message.Count, 1), max(maxRequests, 1))
+	for i := 0; i < count; i++ {
+		entry.limiter.Accept(message.Timestamp)
+	}
+	if rb.heavyHitters != nil {
+		rb.heavyHitters.accepted.add(message.Key, uint64(count))
+	}
 
-func (rb *RateBroker) getLimiter(key string) limiter.Limiter {
-	var userLimiter limiter.Limiter
+	if len(rb.hooks.remoteApply) > 0 {
+		var limitDetails LimitDetails
+		limitDetails.MaxRequests, limitDetails.Window = entry.limiter.LimitDetails()
+		callHooks(rb.hooks.remoteApply, message.Key, limitDetails, message.Timestamp)
+	}
+}
 
-	// Try to get the limiter from cache
+func (rb *RateBroker) getEntry(key string) *keyEntry {
+	// Try to get the entry from cache
 	item, found := rb.cache.Get(key)
 	if !found {
 		return nil
 	}
 
-	// Assert the type to your limiter interface or struct
-	userLimiter = item.(limiter.Limiter)
-	return userLimiter
+	return item.(*keyEntry)
+}
+
+// getOrCreateEntry returns the entry for the key, creating it if it does not exist.
+// Creation is serialized per shard of the keys, and the cache applies new entries
+// asynchronously, so the tracked entry is looked up before the cache: concurrent
+// requests and messages for a new key share a single limiter.
+//
+// An entry whose limiter does not match the key's policy or the limiter type anymore,
+// e.g. after UpdatePolicy or ApplyConfig, is replaced with one that does.
+func (rb *RateBroker) getOrCreateEntry(key string) *keyEntry {
+	policy := rb.policyFor(key)
+	limiterType, newLimiterFunc := rb.limiterFor()
+	if entry := rb.getEntry(key); entry != nil && entry.matches(policy, limiterType) {
+		return entry
+	}
+
+	mutex := rb.entryMutex(key)
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	previous := rb.trackedEntry(key)
+	if previous == nil {
+		previous = rb.getEntry(key)
+	}
+	if previous != nil && previous.matches(policy, limiterType) {
+		return previous
+	}
+
+	// Keep the requests recorded for the key when its limiter can be resized
+	if previous != nil && previous.limiterType == limiterType {
+		if resizer, ok := previous.limiter.(limiter.Resizer); ok {
+			resizer.Resize(policy.MaxRequests, policy.Window)
+			previous.setPolicy(policy)
+			return previous
+		}
+	}
+
+	entry := &keyEntry{
+		key:         key,
+		limiter:     newLimiterFunc(policy.MaxRequests, policy.Window),
+		limiterType: limiterType,
+		// Events beyond twice the limit within a window are rare, older IDs are forgotten
+		seen:    newDedupeWindow(2 * policy.MaxRequests),
+		penalty: rb.newPenaltyState(),
+	}
+	if previous != nil {
+		entry.seen, entry.penalty = previous.seen, previous.penalty
+	}
+	entry.setPolicy(policy)
+	rb.trackEntry(entry)
+	if !rb.cache.Set(key, entry, 1) {
+		// Dropped under contention, the cache will not call untrackEntry for it
+		rb.untrackEntry(entry)
+	}
+
+	return entry
+}
+
+// entryShards is the number of mutexes the creation of the entries is sharded across.
+const entryShards = 64
+
+// entryMutex returns the mutex serializing the creation of the key's entry.
+func (rb *RateBroker) entryMutex(key string) *sync.Mutex {
+	// Inlined FNV-1a, hash/fnv would allocate on the hot path
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return &rb.entryMutexes[h%entryShards]
+}
+
+// matches reports whether the entry's limiter is of the limiter type and was created
+// or resized with the policy.
+func (e *keyEntry) matches(policy LimitDetails, limiterType string) bool {
+	current := e.policy.Load()
+	return e.limiterType == limiterType && current.MaxRequests == policy.MaxRequests && current.Window == policy.Window
+}
+
+// setPolicy records the limit the entry's limiter was created or resized with.
+func (e *keyEntry) setPolicy(policy LimitDetails) {
+	e.policy.Store(&LimitDetails{MaxRequests: policy.MaxRequests, Window: policy.Window})
+}
+
+// trackEntry adds the entry to the keys before it is added to the cache.
+func (rb *RateBroker) trackEntry(entry *keyEntry) {
+	rb.keysMutex.Lock()
+	defer rb.keysMutex.Unlock()
+	rb.keys[entry.key] = entry
+}
+
+// trackedEntry returns the entry tracked for the key, including one the cache has not
+// applied yet.
+func (rb *RateBroker) trackedEntry(key string) *keyEntry {
+	rb.keysMutex.Lock()
+	defer rb.keysMutex.Unlock()
+	return rb.keys[key]
+}
+
+// untrackEntry is called by the cache for every entry that leaves it, when it is
+// evicted, deleted, replaced or not admitted, and removes it from the keys. Replaced
+// entries are not tracked anymore by then, so the OnEvict hooks are not called for them.
+func (rb *RateBroker) untrackEntry(value interface{}) {
+	entry, ok := value.(*keyEntry)
+	if !ok {
+		return
+	}
+
+	rb.keysMutex.Lock()
+	tracked := rb.keys[entry.key] == entry
+	if tracked {
+		delete(rb.keys, entry.key)
+	}
+	rb.keysMutex.Unlock()
+
+	if tracked && len(rb.hooks.evict) > 0 {
+		var limitDetails LimitDetails
+		limitDetails.MaxRequests, limitDetails.Window = entry.limiter.LimitDetails()
+		callHooks(rb.hooks.evict, entry.key, limitDetails, rb.Now())
+	}
+}
+
+// TrackedKeys returns the number of keys the RateBroker currently tracks a limiter for.
+func (rb *RateBroker) TrackedKeys() int {
+	rb.keysMutex.Lock()
+	defer rb.keysMutex.Unlock()
+	return len(rb.keys)
 }
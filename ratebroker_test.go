@@ -4,6 +4,9 @@ package ratebroker_test
 
 import (
 	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,6 +27,21 @@ func BenchmarkRateBroker_Memory(b *testing.B) {
 	}
 }
 
+// Benchmark the creation of the entries of new keys from parallel requests
+func BenchmarkRateBroker_UniqueKeys(b *testing.B) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithWindow(2*time.Second),
+		ratebroker.WithMaxRequests(5),
+	)
+
+	var next atomic.Uint64
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			rb.TryAccept(context.Background(), "user"+strconv.FormatUint(next.Add(1), 10))
+		}
+	})
+}
+
 func TestRateLimiter(t *testing.T) {
 	// Define the configuration for each test case.
 	testCases := []struct {
@@ -78,3 +96,246 @@ func TestRateLimiter(t *testing.T) {
 		})
 	}
 }
+
+// memoryBroker is an in-memory MessageBroker used to test the RateBroker without Redis.
+type memoryBroker struct {
+	mu       sync.Mutex
+	messages []ratebroker.Message
+	handlers []func(ratebroker.Message)
+	ready    chan struct{}
+	// replay delivers every published message to a new consumer, like a broker with an initial load offset
+	replay bool
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{ready: make(chan struct{})}
+}
+
+func (m *memoryBroker) Publish(ctx context.Context, msg ratebroker.Message) error {
+	m.mu.Lock()
+	m.messages = append(m.messages, msg)
+	handlers := append([]func(ratebroker.Message){}, m.handlers...)
+	m.mu.Unlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+func (m *memoryBroker) Consume(ctx context.Context, handlerFunc func(ratebroker.Message)) error {
+	m.mu.Lock()
+	if m.replay {
+		for _, msg := range m.messages {
+			handlerFunc(msg)
+		}
+	}
+	m.handlers = append(m.handlers, handlerFunc)
+	m.mu.Unlock()
+
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (m *memoryBroker) Ready() <-chan struct{} {
+	return m.ready
+}
+
+// waitForConsumers waits until n handlers are consuming from the memoryBroker.
+func waitForConsumers(t *testing.T, m *memoryBroker, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		m.mu.Lock()
+		consumers := len(m.handlers)
+		m.mu.Unlock()
+
+		if consumers >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("Timed out waiting for %d consumers", n)
+}
+
+func TestRateBroker_KeyHashing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	newReplica := func(secret string) *ratebroker.RateBroker {
+		rb := ratebroker.NewRateBroker(
+			ratebroker.WithBroker(broker),
+			ratebroker.WithKeyHashing([]byte(secret)),
+			ratebroker.WithMaxRequests(3),
+			ratebroker.WithWindow(time.Minute),
+		)
+		rb.Start(ctx)
+		return rb
+	}
+
+	replica1 := newReplica("shared-secret")
+	replica2 := newReplica("shared-secret")
+	waitForConsumers(t, broker, 2)
+
+	key := "203.0.113.195"
+	if replica1.StoredKey(key) == key {
+		t.Fatal("Stored key should be hashed")
+	}
+	if replica1.StoredKey(key) != replica2.StoredKey(key) {
+		t.Fatal("Replicas sharing a secret should hash keys the same way")
+	}
+	if replica1.StoredKey(key) == newReplica("other-secret").StoredKey(key) {
+		t.Error("Replicas with different secrets should hash keys differently")
+	}
+
+	for i := 0; i < 3; i++ {
+		if allowed, _ := replica1.TryAccept(ctx, key); !allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if allowed, _ := replica2.TryAccept(ctx, key); allowed {
+		t.Error("Requests accepted by another replica should count towards the limit")
+	}
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for _, msg := range broker.messages {
+		if msg.Key != replica1.StoredKey(key) {
+			t.Errorf("Broadcast key should be hashed, got %q", msg.Key)
+		}
+	}
+}
+
+// published returns a copy of the messages published to the memoryBroker.
+func (m *memoryBroker) published() []ratebroker.Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]ratebroker.Message{}, m.messages...)
+}
+
+func TestRateBroker_TryAcceptN(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	broker, replica1, replica2 := newControlReplicas(t, ctx, 5)
+
+	if allowed, _ := replica1.TryAcceptN(ctx, "user1", 3); !allowed {
+		t.Fatal("Requests within the limit should be allowed")
+	}
+	if allowed, _ := replica1.TryAcceptN(ctx, "user1", 3); allowed {
+		t.Fatal("Requests over the remaining limit should be rejected")
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	// The requests are broadcast in a single message
+	if published := broker.published(); len(published) != 1 || published[0].Count != 3 {
+		t.Fatalf("Expected a single message with a count of 3, got %+v", published)
+	}
+
+	result := replica2.Check(ctx, "user1", 2)
+	if !result.Allowed || result.Decision != ratebroker.DecisionAccepted {
+		t.Fatalf("Expected the remaining requests to be accepted, got %+v", result)
+	}
+	if result := replica2.Check(ctx, "user1", 1); result.Allowed || result.Decision != ratebroker.DecisionRejected {
+		t.Errorf("Expected every request accepted by the other replica to be counted, got %+v", result)
+	}
+}
+
+// singleLimiter hides every method of the wrapped limiter but the ones of limiter.Limiter,
+// like a custom limiter that does not implement limiter.CostLimiter.
+type singleLimiter struct {
+	limiter.Limiter
+}
+
+func TestRateBroker_TryAcceptNWithoutCostLimiter(t *testing.T) {
+	ctx := context.Background()
+	newRing := limiter.NewRingLimiterConstructorFunc()
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(10),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithLimiterContructorFunc(func(maxRequests int, window time.Duration) limiter.Limiter {
+			return singleLimiter{newRing(maxRequests, window)}
+		}),
+	)
+
+	for i := 0; i < 9; i++ {
+		if allowed, _ := rb.TryAccept(ctx, "user1"); !allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+	if allowed, _ := rb.TryAcceptN(ctx, "user1", 5); allowed {
+		t.Error("Expected a cost over 1 to be rejected by a limiter that cannot check it")
+	}
+	if allowed, _ := rb.TryAccept(ctx, "user1"); !allowed {
+		t.Error("Expected the last request within the limit to be allowed")
+	}
+	if allowed, _ := rb.TryAccept(ctx, "user1"); allowed {
+		t.Error("Expected the key to be at its limit")
+	}
+}
+
+func TestRateBroker_CustomLimiterRoundingWindow(t *testing.T) {
+	ctx := context.Background()
+	newRing := limiter.NewRingLimiterConstructorFunc()
+
+	// The limiter reports a window other than the one it was created with
+	var created atomic.Int32
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(2),
+		ratebroker.WithWindow(1500*time.Millisecond),
+		ratebroker.WithLimiterContructorFunc(func(maxRequests int, window time.Duration) limiter.Limiter {
+			created.Add(1)
+			return newRing(maxRequests, window.Round(time.Second))
+		}),
+	)
+
+	for i := 0; i < 2; i++ {
+		if allowed, _ := rb.TryAccept(ctx, "user1"); !allowed {
+			t.Fatalf("Request %d should be allowed", i)
+		}
+	}
+	if allowed, _ := rb.TryAccept(ctx, "user1"); allowed {
+		t.Error("Expected the limiter to keep its requests")
+	}
+	if n := created.Load(); n != 1 {
+		t.Errorf("Expected a single limiter for the key, got %d", n)
+	}
+}
+
+func TestRateBroker_ConcurrentNewKey(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithMaxRequests(5),
+	)
+
+	// Requests racing to create the entry of each new key share its limiter
+	for k := 0; k < 20; k++ {
+		key := "user" + strconv.Itoa(k)
+
+		var allowed atomic.Int32
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				<-start
+				if ok, _ := rb.TryAccept(context.Background(), key); ok {
+					allowed.Add(1)
+				}
+			}()
+		}
+		close(start)
+		wg.Wait()
+
+		if n := allowed.Load(); n != 5 {
+			t.Errorf("Expected 5 requests for %s to be allowed, got %d", key, n)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package ratebroker
+
+import "golang.org/x/exp/slog"
+
+// WithShadowMode enables shadow mode, also known as dry-run mode, to observe the effect
+// of new limits before enforcing them. TryAccept allows every request, and the requests
+// that would have been rejected are logged as warnings sampled by WithLogSampling,
+// counted by ShadowRejections, reported with LimitDetails.WouldReject and passed to
+// onReject if it is not nil.
+//
+// Requests that would have been rejected are not counted towards the limit, the same as
+// rejected requests are not, so the reports match what enforcing the limits would do.
+// Bans from the penalty box are not broadcast in shadow mode.
+func WithShadowMode(onReject func(key string, details LimitDetails)) Option {
+	return func(rb *RateBroker) {
+		rb.shadowMode = true
+		rb.onShadowReject = onReject
+	}
+}
+
+// ShadowRejections returns the number of requests allowed in shadow mode that would have been rejected.
+func (rb *RateBroker) ShadowRejections() uint64 {
+	return rb.shadowRejects.Load()
+}
+
+// shadowReject records a request that would have been rejected and returns its details marked as such.
+func (rb *RateBroker) shadowReject(key, storedKey string, details LimitDetails) LimitDetails {
+	details.WouldReject = true
+	rb.shadowRejects.Add(1)
+
+	rb.logger.Warn("request would be rejected", slog.String("key", storedKey), slog.Int("max_requests", details.MaxRequests), slog.Duration("window", details.Window))
+
+	if rb.onShadowReject != nil {
+		rb.onShadowReject(key, details)
+	}
+	return details
+}
@@ -0,0 +1,108 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+	"golang.org/x/exp/slog"
+)
+
+func TestRateBroker_ShadowMode(t *testing.T) {
+	ctx := context.Background()
+
+	var mu sync.Mutex
+	var reported []string
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(2),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithShadowMode(func(key string, details ratebroker.LimitDetails) {
+			mu.Lock()
+			defer mu.Unlock()
+			reported = append(reported, key)
+		}),
+	)
+
+	var wouldReject int
+	for i := 0; i < 5; i++ {
+		allowed, details := rb.TryAccept(ctx, "user1")
+		if !allowed {
+			t.Fatalf("Request %d should be allowed in shadow mode", i)
+		}
+		if details.WouldReject {
+			wouldReject++
+		}
+	}
+
+	if wouldReject != 3 {
+		t.Errorf("Expected 3 requests marked as would reject, got %d", wouldReject)
+	}
+	if rb.ShadowRejections() != 3 {
+		t.Errorf("Expected 3 shadow rejections, got %d", rb.ShadowRejections())
+	}
+	if len(reported) != 3 || reported[0] != "user1" {
+		t.Errorf("Expected 3 rejections of user1 reported, got %v", reported)
+	}
+
+	if err := rb.AddToDenyList(ctx, "user2"); err != nil {
+		t.Fatalf("Unexpected error adding to the deny list: %v", err)
+	}
+	if allowed, details := rb.TryAccept(ctx, "user2"); !allowed || !details.WouldReject {
+		t.Error("Denied key should be allowed and marked as would reject in shadow mode")
+	}
+}
+
+func TestRateBroker_ShadowModeLogSampling(t *testing.T) {
+	var logs logBuffer
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithShadowMode(nil),
+		ratebroker.WithLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+	)
+
+	for i := 0; i < 50; i++ {
+		rb.TryAccept(context.Background(), "user1")
+	}
+
+	if n := rb.ShadowRejections(); n != 49 {
+		t.Errorf("Expected 49 shadow rejections, got %d", n)
+	}
+	records := logs.records(t, "request would be rejected")
+	if len(records) != 10 {
+		t.Fatalf("Expected the would-be rejections to be sampled to 10 records, got %d", len(records))
+	}
+	if records[0]["level"] != "WARN" {
+		t.Errorf("Expected the would-be rejections to be logged as warnings, got %v", records[0]["level"])
+	}
+}
+
+func TestHttpMiddleware_WouldLimit(t *testing.T) {
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithShadowMode(nil),
+	)
+
+	handler := ratebroker.HttpMiddleware(rb, func(r *http.Request) string {
+		return "user1"
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for i, expected := range []string{"", "true", "true"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if rec.Code != http.StatusOK {
+			t.Errorf("Request %d: expected status 200 in shadow mode, got %d", i, rec.Code)
+		}
+		if header := rec.Header().Get("X-Rate-Limit-Would-Limit"); header != expected {
+			t.Errorf("Request %d: expected would limit header %q, got %q", i, expected, header)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package ratebroker
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/exp/slog"
+)
+
+var (
+	// ErrUnsigned is returned when verifying a message without a signature.
+	ErrUnsigned = errors.New("message is not signed")
+	// ErrUnknownSigningKey is returned when a message is signed with a key that is not configured.
+	ErrUnknownSigningKey = errors.New("message is signed with an unknown key")
+	// ErrInvalidSignature is returned when a message's signature does not match its contents.
+	ErrInvalidSignature = errors.New("message signature is invalid")
+)
+
+// SigningBroker is a MessageBroker that wraps another broker and authenticates the messages
+// sent through it. Every published message is signed with an HMAC-SHA256 of its fields using
+// a shared key, and consumed messages that are unsigned or whose signature does not match
+// are dropped before they reach the RateBroker.
+//
+// Multiple keys can be active at the same time to rotate keys without downtime:
+// add the new key on every replica, switch the signing key, then remove the old key.
+type SigningBroker struct {
+	broker MessageBroker
+
+	signingKeyID string
+	keys         map[string][]byte
+	mutex        sync.RWMutex
+
+	rejected atomic.Uint64
+	logger   *slog.Logger
+}
+
+// NewSigningBroker wraps broker so that messages are signed with the key identified by keyID.
+// The key is also used to verify consumed messages, additional verification keys can be
+// supplied with WithVerificationKey.
+func NewSigningBroker(broker MessageBroker, keyID string, key []byte, opts ...func(*SigningBroker)) *SigningBroker {
+	sb := &SigningBroker{
+		broker:       broker,
+		signingKeyID: keyID,
+		keys:         map[string][]byte{keyID: key},
+	}
+
+	// Apply all provided options
+	for _, opt := range opts {
+		opt(sb)
+	}
+	sb.logger = defaultLogSampling.newLogger(sb.logger)
+
+	return sb
+}
+
+// WithVerificationKey adds a key that is accepted when verifying consumed messages
+// but not used for signing, e.g. the previous key during a rotation.
+func WithVerificationKey(keyID string, key []byte) func(*SigningBroker) {
+	return func(sb *SigningBroker) {
+		sb.keys[keyID] = key
+	}
+}
+
+// AddKey adds or replaces a key accepted when verifying consumed messages.
+func (sb *SigningBroker) AddKey(keyID string, key []byte) {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+	sb.keys[keyID] = key
+}
+
+// RemoveKey stops accepting messages signed with the key. The signing key cannot be removed.
+func (sb *SigningBroker) RemoveKey(keyID string) error {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if keyID == sb.signingKeyID {
+		return fmt.Errorf("cannot remove signing key %q", keyID)
+	}
+	delete(sb.keys, keyID)
+	return nil
+}
+
+// SetSigningKey switches the key used to sign published messages to a previously added key.
+func (sb *SigningBroker) SetSigningKey(keyID string) error {
+	sb.mutex.Lock()
+	defer sb.mutex.Unlock()
+
+	if _, ok := sb.keys[keyID]; !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownSigningKey, keyID)
+	}
+	sb.signingKeyID = keyID
+	return nil
+}
+
+// Publish signs the message and publishes it to the wrapped broker.
+func (sb *SigningBroker) Publish(ctx context.Context, msg Message) error {
+	sb.mutex.RLock()
+	keyID, key := sb.signingKeyID, sb.keys[sb.signingKeyID]
+	sb.mutex.RUnlock()
+
+	msg.Signature = keyID + ":" + base64.RawStdEncoding.EncodeToString(signMessage(key, msg))
+	return sb.broker.Publish(ctx, msg)
+}
+
+// Consume consumes from the wrapped broker and only passes messages with a valid signature to handlerFunc.
+func (sb *SigningBroker) Consume(ctx context.Context, handlerFunc func(Message)) error {
+	return sb.broker.Consume(ctx, func(msg Message) {
+		if err := sb.Verify(msg); err != nil {
+			sb.rejected.Add(1)
+			sb.logger.Warn("rejecting message", slog.Any("error", err.Error()), slog.String("broker_id", msg.BrokerID))
+			return
+		}
+
+		handlerFunc(msg)
+	})
+}
+
+// Verify checks that the message is signed with one of the active keys and has not been tampered with.
+func (sb *SigningBroker) Verify(msg Message) error {
+	if msg.Signature == "" {
+		return ErrUnsigned
+	}
+
+	keyID, encoded, ok := strings.Cut(msg.Signature, ":")
+	if !ok {
+		return ErrInvalidSignature
+	}
+
+	sb.mutex.RLock()
+	key, ok := sb.keys[keyID]
+	sb.mutex.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %q", ErrUnknownSigningKey, keyID)
+	}
+
+	signature, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || !hmac.Equal(signature, signMessage(key, msg)) {
+		return ErrInvalidSignature
+	}
+
+	return nil
+}
+
+// Ready forwards to the wrapped broker if it implements ReadinessNotifier.
+func (sb *SigningBroker) Ready() <-chan struct{} {
+	if notifier, ok := sb.broker.(ReadinessNotifier); ok {
+		return notifier.Ready()
+	}
+
+	ready := make(chan struct{})
+	close(ready)
+	return ready
+}
+
+// Lag forwards to the wrapped broker if it implements LagReporter.
+func (sb *SigningBroker) Lag(ctx context.Context) (Lag, error) {
+	if reporter, ok := sb.broker.(LagReporter); ok {
+		return reporter.Lag(ctx)
+	}
+
+	return Lag{}, ErrLagNotSupported
+}
+
+// ConsumerStats reports the wrapped broker's stats along with the number of rejected messages.
+func (sb *SigningBroker) ConsumerStats() ConsumerStats {
+	var stats ConsumerStats
+	if reporter, ok := sb.broker.(StatsReporter); ok {
+		stats = reporter.ConsumerStats()
+	}
+
+	stats.Rejected += sb.rejected.Load()
+	return stats
+}
+
+// signMessage returns the HMAC-SHA256 of every field of the message apart from the signature.
+// Each field is length prefixed so that moving bytes between fields changes the signature.
+func signMessage(key []byte, msg Message) []byte {
+	mac := hmac.New(sha256.New, key)
+
+	var timestamp int64
+	if !msg.Timestamp.IsZero() {
+		timestamp = msg.Timestamp.UnixNano()
+	}
+
+	for _, field := range []string{
+		msg.ID,
+		msg.BrokerID,
+		msg.Event,
+		strconv.FormatInt(timestamp, 10),
+		msg.Key,
+		strconv.Itoa(msg.MaxRequests),
+		strconv.FormatInt(int64(msg.Window), 10),
+		strconv.FormatInt(int64(msg.Duration), 10),
+		msg.TraceParent,
+	} {
+		fmt.Fprintf(mac, "%d:%s", len(field), field)
+	}
+	// The count is only signed when set, so that the signatures of the other messages
+	// match the ones of replicas that do not know the field
+	if msg.Count != 0 {
+		field := strconv.Itoa(msg.Count)
+		fmt.Fprintf(mac, "%d:%s", len(field), field)
+	}
+
+	return mac.Sum(nil)
+}
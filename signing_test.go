@@ -0,0 +1,206 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+	"golang.org/x/exp/slog"
+)
+
+func TestSigningBroker(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	inner := newMemoryBroker()
+	signer := ratebroker.NewSigningBroker(inner, "key-1", []byte("secret-1"))
+
+	received := make(chan ratebroker.Message, 10)
+	go signer.Consume(ctx, func(msg ratebroker.Message) {
+		received <- msg
+	})
+	waitForConsumers(t, inner, 1)
+
+	msg := ratebroker.Message{
+		BrokerID:  "broker-1",
+		Event:     ratebroker.RequestAccepted,
+		Timestamp: time.Now(),
+		Key:       "user1",
+	}
+
+	if err := signer.Publish(ctx, msg); err != nil {
+		t.Fatalf("Unexpected error publishing: %v", err)
+	}
+	select {
+	case got := <-received:
+		if got.Key != msg.Key {
+			t.Errorf("Unexpected message received: %+v", got)
+		}
+	default:
+		t.Fatal("Signed message should be passed to the handler")
+	}
+
+	// Unsigned message injected straight into the stream
+	inner.Publish(ctx, msg)
+
+	// Tampered message reusing a valid signature
+	signed := inner.messages[0]
+	signed.BrokerID = "spoofed"
+	inner.Publish(ctx, signed)
+
+	// Message with an inflated count
+	signed = inner.messages[0]
+	signed.Count = 100
+	inner.Publish(ctx, signed)
+
+	// Message signed with an unknown key
+	ratebroker.NewSigningBroker(inner, "key-2", []byte("secret-2")).Publish(ctx, msg)
+
+	select {
+	case got := <-received:
+		t.Fatalf("Invalid message should not be passed to the handler: %+v", got)
+	default:
+	}
+
+	if rejected := signer.ConsumerStats().Rejected; rejected != 4 {
+		t.Errorf("Expected 4 rejected messages, got %d", rejected)
+	}
+}
+
+func TestSigningBroker_Verify(t *testing.T) {
+	signer := ratebroker.NewSigningBroker(newMemoryBroker(), "key-1", []byte("secret-1"))
+
+	testCases := []struct {
+		description string
+		signature   string
+		expected    error
+	}{
+		{"unsigned", "", ratebroker.ErrUnsigned},
+		{"unknown key", "key-9:c2lnbmF0dXJl", ratebroker.ErrUnknownSigningKey},
+		{"invalid signature", "key-1:c2lnbmF0dXJl", ratebroker.ErrInvalidSignature},
+		{"malformed signature", "signature", ratebroker.ErrInvalidSignature},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.description, func(t *testing.T) {
+			err := signer.Verify(ratebroker.Message{Key: "user1", Signature: tc.signature})
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("Expected error %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestSigningBroker_KeyRotation(t *testing.T) {
+	ctx := context.Background()
+	msg := ratebroker.Message{BrokerID: "broker-1", Event: ratebroker.RequestAccepted, Timestamp: time.Now(), Key: "user1"}
+
+	// An old replica still signing with the old key
+	oldInner := newMemoryBroker()
+	oldReplica := ratebroker.NewSigningBroker(oldInner, "key-1", []byte("secret-1"))
+	oldReplica.Publish(ctx, msg)
+	signedWithOld := oldInner.messages[0]
+
+	// A new replica signing with the new key that still accepts the old one
+	newInner := newMemoryBroker()
+	newReplica := ratebroker.NewSigningBroker(newInner, "key-2", []byte("secret-2"),
+		ratebroker.WithVerificationKey("key-1", []byte("secret-1")),
+	)
+	newReplica.Publish(ctx, msg)
+	signedWithNew := newInner.messages[0]
+
+	if err := newReplica.Verify(signedWithOld); err != nil {
+		t.Errorf("Message signed with the old key should be accepted during the rotation: %v", err)
+	}
+	if err := newReplica.Verify(signedWithNew); err != nil {
+		t.Errorf("Message signed with the new key should be accepted: %v", err)
+	}
+
+	// Old replicas learn the new key and switch to it
+	oldReplica.AddKey("key-2", []byte("secret-2"))
+	if err := oldReplica.SetSigningKey("key-2"); err != nil {
+		t.Fatalf("Unexpected error switching signing key: %v", err)
+	}
+	if err := oldReplica.Verify(signedWithNew); err != nil {
+		t.Errorf("Message signed with the new key should be accepted after adding it: %v", err)
+	}
+
+	// Once every replica signs with the new key the old key is removed
+	if err := newReplica.RemoveKey("key-1"); err != nil {
+		t.Fatalf("Unexpected error removing key: %v", err)
+	}
+	if err := newReplica.Verify(signedWithOld); !errors.Is(err, ratebroker.ErrUnknownSigningKey) {
+		t.Errorf("Message signed with a removed key should be rejected, got %v", err)
+	}
+	if err := newReplica.RemoveKey("key-2"); err == nil {
+		t.Error("Removing the signing key should fail")
+	}
+	if err := newReplica.SetSigningKey("key-1"); !errors.Is(err, ratebroker.ErrUnknownSigningKey) {
+		t.Errorf("Switching to a removed key should fail, got %v", err)
+	}
+}
+
+// Signatures cover the keys as published, so they survive a BinaryCodec with HashKeys
+// as long as the keys are hashed before they are published, e.g. by WithKeyHashing.
+func TestSigningBroker_BinaryCodecHashKeys(t *testing.T) {
+	inner := newMemoryBroker()
+	signer := ratebroker.NewSigningBroker(inner, "key-1", []byte("secret-1"))
+	codec := ratebroker.BinaryCodec{HashKeys: true}
+
+	messages := []ratebroker.Message{
+		{BrokerID: "broker-1", Event: ratebroker.RequestAccepted, Timestamp: time.Now(), Key: ratebroker.HashKey("user1")},
+		{BrokerID: "broker-1", Event: ratebroker.DenyListAdded, Timestamp: time.Now(), Key: "10.0.0.0/8"},
+	}
+	for _, msg := range messages {
+		if err := signer.Publish(context.Background(), msg); err != nil {
+			t.Fatalf("Unexpected error publishing: %v", err)
+		}
+	}
+
+	published := inner.published()
+	if len(published) != len(messages) {
+		t.Fatalf("Expected %d messages published, got %d", len(messages), len(published))
+	}
+	for _, msg := range published {
+		data, err := codec.Encode(msg)
+		if err != nil {
+			t.Fatalf("Unexpected error encoding: %v", err)
+		}
+		decoded, err := codec.Decode(data)
+		if err != nil {
+			t.Fatalf("Unexpected error decoding: %v", err)
+		}
+		if err := signer.Verify(decoded); err != nil {
+			t.Errorf("Expected the signature of %s to verify after decoding, got %v", decoded.Key, err)
+		}
+	}
+}
+
+func TestSigningBroker_LogSampling(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var logs logBuffer
+	inner := newMemoryBroker()
+	signer := ratebroker.NewSigningBroker(inner, "key-1", []byte("secret-1"),
+		ratebroker.WithSigningLogger(slog.New(slog.NewJSONHandler(&logs, nil))),
+	)
+	go signer.Consume(ctx, func(ratebroker.Message) {})
+	waitForConsumers(t, inner, 1)
+
+	// Unsigned messages injected straight into the stream
+	for i := 0; i < 20; i++ {
+		inner.Publish(ctx, ratebroker.Message{Event: ratebroker.RequestAccepted, Key: "user1"})
+	}
+
+	if rejected := signer.ConsumerStats().Rejected; rejected != 20 {
+		t.Errorf("Expected 20 rejected messages, got %d", rejected)
+	}
+	if records := logs.records(t, "rejecting message"); len(records) != 10 {
+		t.Errorf("Expected the rejections to be sampled to 10 records, got %d", len(records))
+	}
+}
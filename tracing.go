@@ -0,0 +1,56 @@
+package ratebroker
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerName is the name of the OpenTelemetry tracer used by the package.
+const tracerName = "github.com/parkerroan/ratebroker"
+
+// traceParentHeader is the W3C Trace Context header carried by Message.TraceParent.
+const traceParentHeader = "traceparent"
+
+// traceContext propagates the trace context inside messages in the W3C Trace Context format.
+var traceContext = propagation.TraceContext{}
+
+// noopTracer is used when no TracerProvider is configured.
+var noopTracer = noop.NewTracerProvider().Tracer(tracerName)
+
+// WithTracerProvider enables OpenTelemetry tracing of the RateBroker. Every TryAccept
+// gets a span with the key, decision and limit as attributes, with a child span for the
+// message it publishes. The trace context is sent along with the message so that the
+// replicas consuming it can link back to the request, see WithBrokerTracerProvider.
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(rb *RateBroker) {
+		rb.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// WithBrokerTracerProvider enables OpenTelemetry tracing of the broker. Every batch of
+// messages consumed gets a span linked to the spans that published its messages.
+func WithBrokerTracerProvider(tp trace.TracerProvider) func(*RedisMessageBroker) {
+	return func(r *RedisMessageBroker) {
+		r.tracer = tp.Tracer(tracerName)
+	}
+}
+
+// injectTraceParent returns the W3C traceparent of the span in ctx, empty if there is none.
+func injectTraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	return carrier[traceParentHeader]
+}
+
+// extractTraceParent returns the span context of a W3C traceparent, invalid if it cannot be parsed.
+func extractTraceParent(traceParent string) trace.SpanContext {
+	if traceParent == "" {
+		return trace.SpanContext{}
+	}
+
+	carrier := propagation.MapCarrier{traceParentHeader: traceParent}
+	return trace.SpanContextFromContext(traceContext.Extract(context.Background(), carrier))
+}
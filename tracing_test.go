@@ -0,0 +1,104 @@
+//go:build unit
+
+package ratebroker_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/parkerroan/ratebroker"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanAttributes returns the attributes of the span by key.
+func spanAttributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attributes := make(map[attribute.Key]attribute.Value)
+	for _, kv := range span.Attributes() {
+		attributes[kv.Key] = kv.Value
+	}
+	return attributes
+}
+
+func TestRateBroker_Tracing(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(
+		ratebroker.WithBroker(broker),
+		ratebroker.WithMaxRequests(1),
+		ratebroker.WithWindow(time.Minute),
+		ratebroker.WithTracerProvider(tp),
+	)
+	rb.Start(ctx)
+
+	rb.TryAccept(ctx, "user1")
+	rb.TryAccept(ctx, "user1")
+	time.Sleep(20 * time.Millisecond)
+
+	var tryAccepts []sdktrace.ReadOnlySpan
+	var publish sdktrace.ReadOnlySpan
+	for _, span := range recorder.Ended() {
+		switch span.Name() {
+		case "ratebroker.TryAccept":
+			tryAccepts = append(tryAccepts, span)
+		case "ratebroker.Publish":
+			publish = span
+		}
+	}
+
+	if len(tryAccepts) != 2 {
+		t.Fatalf("Expected a span per TryAccept, got %d", len(tryAccepts))
+	}
+	for i, decision := range []string{ratebroker.DecisionAccepted, ratebroker.DecisionRejected} {
+		attributes := spanAttributes(tryAccepts[i])
+		if got := attributes["ratebroker.decision"].AsString(); got != decision {
+			t.Errorf("Expected decision %q, got %q", decision, got)
+		}
+		if got := attributes["ratebroker.key"].AsString(); got != "user1" {
+			t.Errorf("Expected key user1, got %q", got)
+		}
+		if got := attributes["ratebroker.max_requests"].AsInt64(); got != 1 {
+			t.Errorf("Expected max requests 1, got %d", got)
+		}
+	}
+
+	if publish == nil {
+		t.Fatal("Expected a span for the publish")
+	}
+	if publish.Parent().SpanID() != tryAccepts[0].SpanContext().SpanID() {
+		t.Error("Publish span should be a child of the accepted TryAccept span")
+	}
+
+	messages := broker.published()
+	if len(messages) != 1 {
+		t.Fatalf("Expected 1 published message, got %d", len(messages))
+	}
+	want := "00-" + publish.SpanContext().TraceID().String() + "-" + publish.SpanContext().SpanID().String() + "-01"
+	if messages[0].TraceParent != want {
+		t.Errorf("Expected the message to carry the publish span %q, got %q", want, messages[0].TraceParent)
+	}
+}
+
+func TestRateBroker_NoTracing(t *testing.T) {
+	broker := newMemoryBroker()
+	close(broker.ready)
+
+	rb := ratebroker.NewRateBroker(ratebroker.WithBroker(broker))
+	rb.TryAccept(context.Background(), "user1")
+	time.Sleep(20 * time.Millisecond)
+
+	for _, msg := range broker.published() {
+		if msg.TraceParent != "" {
+			t.Errorf("Messages should not carry a trace context without tracing, got %q", msg.TraceParent)
+		}
+	}
+}